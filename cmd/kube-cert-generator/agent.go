@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/urfave/cli.v2"
+)
+
+// RenewalHook is command run after certificates are renewed
+type RenewalHook struct {
+	Command []string `toml:"command" yaml:"command" json:"command"`
+	Certs   []string `toml:"certs" yaml:"certs" json:"certs"` // names of certificates which trigger hook, empty means all
+	Timeout Duration `toml:"timeout" yaml:"timeout" json:"timeout"`
+}
+
+// RenewalConfig configures agent command
+type RenewalConfig struct {
+	RenewBefore Duration      `toml:"renew_before" yaml:"renew_before" json:"renew_before"` // renew certificates expiring within this period
+	Interval    Duration      `toml:"interval" yaml:"interval" json:"interval"`
+	Hooks       []RenewalHook `toml:"hook" yaml:"hook" json:"hook"`
+}
+
+const (
+	defaultRenewBefore   = 30 * 24 * time.Hour
+	defaultRenewInterval = time.Hour
+	defaultHookTimeout   = time.Minute
+
+	// failed renewals are retried after exponentially growing delay
+	minRenewBackoff = time.Minute
+	maxRenewBackoff = 24 * time.Hour
+
+	renewLockFile = ".renew.lock"
+
+	renewedCertsEnv = "KUBE_CERT_GENERATOR_RENEWED"
+)
+
+var (
+	renewBeforeFlag = cli.StringFlag{
+		Name:  "renew-before",
+		Usage: "renew certificates which expire within this period, e.g. 30d (overrides renewal.renew_before)",
+	}
+	renewIntervalFlag = cli.DurationFlag{
+		Name:  "interval",
+		Usage: "interval between checks (overrides renewal.interval)",
+	}
+)
+
+var agentCmd = cli.Command{
+	Name:  "agent",
+	Usage: "Periodically renew expiring certificates in output dir and run renewal hooks",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+		&outputsFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+		&renewBeforeFlag,
+		&renewIntervalFlag,
+		&onceFlag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if err := initConfig(ctx); err != nil {
+			return err
+		}
+		return initOutputDir(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		cfg := ctx.App.Metadata[configContextKey].(*Config)
+		agent := newRenewAgent(cfg, ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string), signOptions{
+			Outputs:        ctx.StringSlice(outputsFlag.Name),
+			PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+			PKCS12Password: passwordFromContext(ctx, true),
+		})
+		if value := ctx.String(renewBeforeFlag.Name); value != "" {
+			renewBefore, err := parseExpiryPeriod(value)
+			if err != nil {
+				return fmt.Errorf("--%s: %v", renewBeforeFlag.Name, err)
+			}
+			agent.renewBefore = renewBefore
+		}
+		if interval := ctx.Duration(renewIntervalFlag.Name); interval > 0 {
+			agent.interval = interval
+		}
+
+		if ctx.Bool(onceFlag.Name) {
+			_, err := agent.renewOnce(context.Background())
+			return err
+		}
+		runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Printf("Renew certificates in %s expiring within %s, check every %v\n", agent.outputDir, formatExpiryPeriod(agent.renewBefore), agent.interval)
+		if err := agent.run(runCtx); err != context.Canceled {
+			return err
+		}
+		return nil
+	},
+}
+
+// agentClock is source of time for renewal agent, it is replaced in tests
+type agentClock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// renewBackoff delays next renewal attempt after failures
+type renewBackoff struct {
+	Failures int
+	Next     time.Time
+}
+
+// renewAgent renews certificates in output dir by signing their existing CSRs again
+type renewAgent struct {
+	cfg         *Config
+	caName      string
+	outputDir   string
+	opts        signOptions
+	renewBefore time.Duration
+	interval    time.Duration
+	clock       agentClock
+
+	sign    func(cfg *Config, files []string, caName, outputDir string, opts signOptions) error
+	runHook func(ctx context.Context, hook RenewalHook, renewed []string) error
+
+	backoff map[string]*renewBackoff
+}
+
+func newRenewAgent(cfg *Config, caName, outputDir string, opts signOptions) *renewAgent {
+	ret := &renewAgent{
+		cfg:         cfg,
+		caName:      caName,
+		outputDir:   outputDir,
+		opts:        opts,
+		renewBefore: cfg.Renewal.RenewBefore.Duration,
+		interval:    cfg.Renewal.Interval.Duration,
+		clock:       systemClock{},
+		sign:        signCSRs,
+		runHook:     runRenewalHook,
+		backoff:     make(map[string]*renewBackoff),
+	}
+	if ret.renewBefore == 0 {
+		ret.renewBefore = defaultRenewBefore
+	}
+	if ret.interval == 0 {
+		ret.interval = defaultRenewInterval
+	}
+	return ret
+}
+
+func backoffDelay(failures int) time.Duration {
+	delay := minRenewBackoff
+	for i := 1; i < failures && delay < maxRenewBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRenewBackoff {
+		delay = maxRenewBackoff
+	}
+	return delay
+}
+
+// renewOnce renews expiring certificates and runs hooks for renewed ones.
+// Certificates without CSR in output dir can not be renewed and are skipped.
+func (a *renewAgent) renewOnce(ctx context.Context) ([]string, error) {
+	lock, err := tryLockFile(path.Join(a.outputDir, renewLockFile))
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		fmt.Println("Output dir is locked by other process, skipped")
+		return nil, nil
+	}
+	defer lock.unlock()
+
+	certFiles, err := filepath.Glob(path.Join(a.outputDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(certFiles)
+
+	// certificates are always overwritten on renewal
+	renewCfg := *a.cfg
+	renewCfg.OverwriteFiles = true
+	var renewed []string
+	for _, certFile := range certFiles {
+		name := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		now := a.clock.Now()
+		cert, err := readCertFile(certFile)
+		if err != nil {
+			fmt.Printf("Skip %s: %v\n", certFile, err)
+			continue
+		}
+		if cert.NotAfter.Sub(now) > a.renewBefore {
+			delete(a.backoff, name)
+			continue
+		}
+		if backoff, ok := a.backoff[name]; ok && now.Before(backoff.Next) {
+			continue
+		}
+		csrFile := path.Join(a.outputDir, name+".csr")
+		if _, err := os.Stat(csrFile); err != nil {
+			fmt.Printf("Skip %s: %v\n", certFile, err)
+			continue
+		}
+
+		fmt.Printf("Renew %s expiring at %s\n", name, cert.NotAfter.UTC().Format(time.RFC3339))
+		if err := a.sign(&renewCfg, []string{csrFile}, a.caName, a.outputDir, a.opts); err != nil {
+			backoff, ok := a.backoff[name]
+			if !ok {
+				backoff = &renewBackoff{}
+				a.backoff[name] = backoff
+			}
+			backoff.Failures++
+			backoff.Next = now.Add(backoffDelay(backoff.Failures))
+			fmt.Printf("Failed to renew %s: %v, retry after %s\n", name, err, backoff.Next.UTC().Format(time.RFC3339))
+			continue
+		}
+		delete(a.backoff, name)
+		renewed = append(renewed, name)
+	}
+
+	if len(renewed) > 0 {
+		a.runHooks(ctx, renewed)
+	}
+	return renewed, nil
+}
+
+// runHooks runs every hook triggered by renewed certificates once. Hook failures are reported but not retried.
+func (a *renewAgent) runHooks(ctx context.Context, renewed []string) {
+	for _, hook := range a.cfg.Renewal.Hooks {
+		var triggered []string
+		for _, name := range renewed {
+			if len(hook.Certs) == 0 || containsString(hook.Certs, name) {
+				triggered = append(triggered, name)
+			}
+		}
+		if len(triggered) == 0 {
+			continue
+		}
+		fmt.Printf("Run hook %v for %s\n", hook.Command, strings.Join(triggered, ", "))
+		if err := a.runHook(ctx, hook, triggered); err != nil {
+			fmt.Printf("Hook %v failed: %v\n", hook.Command, err)
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// runRenewalHook runs hook command with names of renewed certificates in environment
+func runRenewalHook(ctx context.Context, hook RenewalHook, renewed []string) error {
+	timeout := hook.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), renewedCertsEnv+"="+strings.Join(renewed, " "))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// nextCheck returns delay before next check, failed renewals may be retried before interval passes
+func (a *renewAgent) nextCheck() time.Duration {
+	ret := a.interval
+	now := a.clock.Now()
+	for _, backoff := range a.backoff {
+		if delay := backoff.Next.Sub(now); delay < ret {
+			ret = delay
+		}
+	}
+	if ret < 0 {
+		ret = 0
+	}
+	return ret
+}
+
+func (a *renewAgent) run(ctx context.Context) error {
+	for {
+		if _, err := a.renewOnce(ctx); err != nil {
+			fmt.Println("Renewal failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.clock.After(a.nextCheck()):
+		}
+	}
+}
+
+// checkRenewal validates renewal section of config. fileNames contains names of certificates described in config.
+func (v *configValidator) checkRenewal(r RenewalConfig, fileNames map[string]string) {
+	if r.RenewBefore.Duration < 0 {
+		v.addProblem("renewal.renew_before", "must not be negative")
+	}
+	if r.Interval.Duration < 0 {
+		v.addProblem("renewal.interval", "must not be negative")
+	}
+	for i, hook := range r.Hooks {
+		path := fmt.Sprintf("renewal.hook[%d].", i)
+		if len(hook.Command) == 0 || hook.Command[0] == "" {
+			v.addProblem(path+"command", "must be set")
+		}
+		for j, name := range hook.Certs {
+			if _, ok := fileNames[name]; !ok {
+				v.addProblem(fmt.Sprintf("%scerts[%d]", path, j), "unknown certificate %q", name)
+			}
+		}
+		if hook.Timeout.Duration < 0 {
+			v.addProblem(path+"timeout", "must not be negative")
+		}
+	}
+}
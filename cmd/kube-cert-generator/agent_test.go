@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ret := make(chan time.Time, 1)
+	ret <- c.now
+	return ret
+}
+
+// writeTestCert writes self-signed certificate expiring at notAfter and empty CSR to dir
+func writeTestCert(t *testing.T, dir, name string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+".crt"), encodeCerts(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+".csr"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestAgent returns agent for temporary output dir which records signed CSRs and run hooks instead of signing
+func newTestAgent(t *testing.T, clock *fakeClock, signErr error) (agent *renewAgent, signed *[]string, hooks *[][]string) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := &Config{}
+	cfg.Renewal.Hooks = []RenewalHook{{Command: []string{"reload"}}}
+	agent = newRenewAgent(cfg, "root", dir, signOptions{})
+	agent.renewBefore, agent.clock = 30*24*time.Hour, clock
+	signed, hooks = new([]string), new([][]string)
+	agent.sign = func(cfg *Config, files []string, caName, outputDir string, opts signOptions) error {
+		*signed = append(*signed, files...)
+		return signErr
+	}
+	agent.runHook = func(ctx context.Context, hook RenewalHook, renewed []string) error {
+		*hooks = append(*hooks, renewed)
+		return nil
+	}
+	return agent, signed, hooks
+}
+
+func TestRenewOnceRenewsCertificatesWithinRenewWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	agent, signed, hooks := newTestAgent(t, clock, nil)
+	writeTestCert(t, agent.outputDir, "expiring", clock.now.Add(10*24*time.Hour))
+	writeTestCert(t, agent.outputDir, "valid", clock.now.Add(100*24*time.Hour))
+
+	renewed, err := agent.renewOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(renewed, []string{"expiring"}) {
+		t.Errorf("renewed %v, expected [expiring]", renewed)
+	}
+	if expected := []string{path.Join(agent.outputDir, "expiring.csr")}; !reflect.DeepEqual(*signed, expected) {
+		t.Errorf("signed %v, expected %v", *signed, expected)
+	}
+	if expected := [][]string{{"expiring"}}; !reflect.DeepEqual(*hooks, expected) {
+		t.Errorf("hooks run for %v, expected %v", *hooks, expected)
+	}
+
+	// certificate enters renew window later
+	*signed, *hooks = nil, nil
+	clock.now = clock.now.Add(75 * 24 * time.Hour)
+	if renewed, err = agent.renewOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(renewed, []string{"expiring", "valid"}) {
+		t.Errorf("renewed %v, expected [expiring valid]", renewed)
+	}
+}
+
+func TestRenewOnceBacksOffAfterFailure(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	agent, signed, hooks := newTestAgent(t, clock, fmt.Errorf("CA is unavailable"))
+	writeTestCert(t, agent.outputDir, "expiring", clock.now.Add(24*time.Hour))
+
+	for i, step := range []struct {
+		advance time.Duration
+		signed  int
+	}{
+		{0, 1},                 // first attempt fails, retry after 1m
+		{30 * time.Second, 1},  // backoff not passed
+		{30 * time.Second, 2},  // second attempt fails, retry after 2m
+		{time.Minute, 2},       // backoff not passed
+		{time.Minute, 3},       // third attempt fails, retry after 4m
+		{4 * time.Minute, 4},   // fourth attempt fails, retry after 8m
+		{8*time.Minute - 1, 4}, // just before backoff passes
+		{1, 5},                 // fifth attempt fails, retry after 16m
+	} {
+		clock.now = clock.now.Add(step.advance)
+		renewed, err := agent.renewOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(renewed) != 0 {
+			t.Errorf("step %d: renewed %v, expected nothing", i, renewed)
+		}
+		if len(*signed) != step.signed {
+			t.Errorf("step %d: %d sign attempts, expected %d", i, len(*signed), step.signed)
+		}
+	}
+	if len(*hooks) != 0 {
+		t.Errorf("hooks run for %v after failed renewals", *hooks)
+	}
+	if delay := agent.nextCheck(); delay != 16*time.Minute {
+		t.Errorf("next check after %v, expected retry when backoff passes after 16m", delay)
+	}
+	if delay := backoffDelay(100); delay != maxRenewBackoff {
+		t.Errorf("backoff delay %v after many failures, expected %v", delay, maxRenewBackoff)
+	}
+
+	// successful renewal resets backoff
+	agent.sign = func(cfg *Config, files []string, caName, outputDir string, opts signOptions) error { return nil }
+	clock.now = clock.now.Add(16 * time.Minute)
+	if renewed, err := agent.renewOnce(context.Background()); err != nil || len(renewed) != 1 {
+		t.Fatalf("renewed %v, error %v, expected renewal", renewed, err)
+	}
+	if len(agent.backoff) != 0 {
+		t.Errorf("backoff %v is kept after successful renewal", agent.backoff)
+	}
+	if delay := agent.nextCheck(); delay != agent.interval {
+		t.Errorf("next check after %v, expected interval %v", delay, agent.interval)
+	}
+}
+
+func TestRenewOnceSkipsOutputDirLockedByOtherInstance(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	agent, signed, _ := newTestAgent(t, clock, nil)
+	writeTestCert(t, agent.outputDir, "expiring", clock.now.Add(24*time.Hour))
+
+	lock, err := tryLockFile(path.Join(agent.outputDir, renewLockFile))
+	if err != nil || lock == nil {
+		t.Fatalf("failed to take lock: %v", err)
+	}
+	other, err := tryLockFile(path.Join(agent.outputDir, renewLockFile))
+	if err != nil || other != nil {
+		t.Fatalf("second lock taken, error %v", err)
+	}
+	renewed, err := agent.renewOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renewed) != 0 || len(*signed) != 0 {
+		t.Errorf("renewed %v while output dir is locked", renewed)
+	}
+
+	if err := lock.unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if renewed, err = agent.renewOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(renewed, []string{"expiring"}) {
+		t.Errorf("renewed %v after lock was released, expected [expiring]", renewed)
+	}
+}
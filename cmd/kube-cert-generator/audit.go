@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// Actions recorded in issuance log
+const (
+	issuanceIssue  = "issue"
+	issuanceRenew  = "renew"
+	issuanceRevoke = "revoke"
+)
+
+var logHeadFlag = cli.StringFlag{
+	Name:  "head",
+	Usage: "hash of entry recorded earlier, verification fails if log does not contain it (detects truncation)",
+}
+
+// issuanceLogEntry is single line of CA issuance log. Every entry contains hash of previous one,
+// so entries can not be modified or removed without breaking the chain.
+type issuanceLogEntry struct {
+	Seq         int       `json:"seq"`
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	CA          string    `json:"ca"`
+	Name        string    `json:"name"`
+	Serial      string    `json:"serial"`
+	Subject     string    `json:"subject"`
+	Operator    string    `json:"operator"`
+	Profile     string    `json:"profile,omitempty"`
+	CSRHash     string    `json:"csr_sha256,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	PrevHash    string    `json:"prev_hash"`
+	Hash        string    `json:"hash"` // SHA-256 of entry encoded with empty hash
+}
+
+func issuanceLogFile(cfg *Config, caName string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "issuance.log")
+}
+
+func (e issuanceLogEntry) computeHash() (string, error) {
+	e.Hash = ""
+	content, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readIssuanceLog parses all entries of log without verifying them, missing log has no entries
+func readIssuanceLog(file string) ([]issuanceLogEntry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []issuanceLogEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry issuanceLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		ret = append(ret, entry)
+	}
+	return ret, scanner.Err()
+}
+
+// appendIssuanceLog chains entry to the last one and appends it to CA issuance log.
+// Issue of certificate with name whose latest entry is not revocation is recorded as renewal.
+// Log is locked while it is read and appended so concurrent writers can not fork the chain.
+func appendIssuanceLog(cfg *Config, caName string, entry issuanceLogEntry) error {
+	file := issuanceLogFile(cfg, caName)
+	lock, err := lockFile(file + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	entries, err := readIssuanceLog(file)
+	if err != nil {
+		return err
+	}
+	entry.Seq, entry.Time, entry.CA = 1, time.Now().UTC(), caName
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		entry.Seq, entry.PrevHash = last.Seq+1, last.Hash
+	}
+	if entry.Operator == "" {
+		entry.Operator = currentUser()
+	}
+	if entry.Action == issuanceIssue {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].Name == entry.Name {
+				if entries[i].Action != issuanceRevoke {
+					entry.Action = issuanceRenew
+				}
+				break
+			}
+		}
+	}
+	if entry.Hash, err = entry.computeHash(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(entry)
+}
+
+// issuedLogEntry returns log entry describing issued certificate
+func issuedLogEntry(issued *generator.Issued, operator string) issuanceLogEntry {
+	ret := issuanceLogEntry{
+		Action:      issuanceIssue,
+		Name:        issued.Name,
+		Serial:      indexSerial(issued.Cert.SerialNumber),
+		Subject:     issued.Cert.Subject.String(),
+		Operator:    operator,
+		Fingerprint: generator.CertFingerprint(issued.Cert),
+	}
+	if issued.Issue != nil {
+		ret.Profile = issued.Issue.Profile
+	}
+	if issued.CSR != nil {
+		sum := sha256.Sum256(issued.CSR.Raw)
+		ret.CSRHash = hex.EncodeToString(sum[:])
+	}
+	return ret
+}
+
+// verifyIssuanceLog checks sequence numbers, hashes and links of entries, it returns first found problem
+func verifyIssuanceLog(entries []issuanceLogEntry) error {
+	prevHash := ""
+	for i, entry := range entries {
+		if entry.Seq != i+1 {
+			return fmt.Errorf("entry %d: sequence number %d, expected %d (entries were removed or reordered)", i+1, entry.Seq, i+1)
+		}
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("entry %d: previous hash %s does not match hash of entry %d %s", entry.Seq, entry.PrevHash, i, prevHash)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			return fmt.Errorf("entry %d: hash %s does not match content %s (entry was modified)", entry.Seq, entry.Hash, hash)
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
+
+var auditCmd = cli.Command{
+	Name:  "audit",
+	Usage: "Inspect issuance log of certificate authority",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "verify",
+			Usage: "Check that issuance log was not modified",
+			Flags: []cli.Flag{
+				&caNameFlag,
+				&configFlag,
+				&logHeadFlag,
+			},
+			Before: initConfig,
+			Action: func(ctx *cli.Context) error {
+				cfg, caName := ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name)
+				file := issuanceLogFile(cfg, caName)
+				entries, err := readIssuanceLog(file)
+				if err != nil {
+					return err
+				}
+				if err := verifyIssuanceLog(entries); err != nil {
+					return fmt.Errorf("%s: %v", file, err)
+				}
+				if head := ctx.String(logHeadFlag.Name); head != "" {
+					found := false
+					for _, entry := range entries {
+						found = found || entry.Hash == head
+					}
+					if !found {
+						return fmt.Errorf("%s: entry with hash %s not found (log was truncated or replaced)", file, head)
+					}
+				}
+				if len(entries) == 0 {
+					fmt.Printf("%s: no entries\n", file)
+					return nil
+				}
+				last := entries[len(entries)-1]
+				fmt.Printf("OK: %d entries in %s, last entry %d at %s hash %s\n", len(entries), file, last.Seq, last.Time.Format(time.RFC3339), last.Hash)
+				return nil
+			},
+		},
+	},
+}
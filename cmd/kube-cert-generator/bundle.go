@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// bundleCADir is directory inside bundle where CA certificates are written
+const bundleCADir = "ca"
+
+// masterBundleName is used for archive of master node if it has no alias
+const masterBundleName = "master"
+
+var (
+	perNodeFlag = cli.BoolFlag{
+		Name:  "per-node",
+		Usage: "write archive encrypted to recipients of every node to output dir instead of single output",
+	}
+	identityFlag = cli.StringSliceFlag{
+		Name:  "identity",
+		Usage: "path to age identity file or SSH private key, may be repeated",
+	}
+)
+
+var bundleCmd = cli.Command{
+	Name:  "bundle",
+	Usage: "Generate keys, CSRs and certificates for all certificates in config into output dir or archive",
+	Flags: append([]cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+		&outputsFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+		&perNodeFlag,
+		&signingKeyFlag,
+		&signingCertFlag,
+	}, outputSinkFlags...),
+	Before: func(ctx *cli.Context) error {
+		if err := initConfig(ctx); err != nil {
+			return err
+		}
+		if err := initOutputDir(ctx); err != nil {
+			return err
+		}
+		for _, output := range ctx.StringSlice(outputsFlag.Name) {
+			if !isKnownOutput(output) {
+				return fmt.Errorf("unknown output %q, must be one of %v", output, knownOutputs)
+			}
+		}
+		return nil
+	},
+	Action: func(ctx *cli.Context) error {
+		cfg := ctx.App.Metadata[configContextKey].(*Config)
+		opts := signOptions{
+			Outputs:        ctx.StringSlice(outputsFlag.Name),
+			PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+			PKCS12Password: passwordFromContext(ctx, true),
+		}
+		signer, err := loadManifestSigner(ctx, cfg, ctx.String(caNameFlag.Name))
+		if err != nil {
+			return err
+		}
+		if ctx.Bool(perNodeFlag.Name) {
+			outputDir := ctx.App.Metadata[outputDirContextKey].(string)
+			if isArchiveOutput(outputDir) {
+				return fmt.Errorf("--%s writes archives to output dir, %s is not a directory", perNodeFlag.Name, outputDir)
+			}
+			return writeNodeBundles(cfg, ctx.String(caNameFlag.Name), outputDir, opts, signer)
+		}
+		return withOutputSink(ctx, func(sink generator.Sink, target string) error {
+			caFiles, err := writeBundle(cfg, ctx.String(caNameFlag.Name), sink, target, opts)
+			if err != nil {
+				return err
+			}
+			manifest, err := buildManifest(cfg, sink, nil, caFiles)
+			if err != nil {
+				return err
+			}
+			return writeManifest(manifest, signer, sink, target)
+		})
+	},
+}
+
+// writeBundle generates keys and CSRs for all certificates in config, signs them and writes certificates
+// of signing CAs to fs. CA store is not changed except for index of issued certificates.
+// Names of written CA certificates are returned.
+func writeBundle(cfg *Config, caName string, fs generator.FS, outputDir string, opts signOptions) ([]string, error) {
+	results, err := generateCSRs(cfg, fs, outputDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, result := range results {
+		files = append(files, result.CSRFile)
+	}
+	if err := signCSRsTo(cfg, fs, files, caName, fs, outputDir, opts); err != nil {
+		return nil, err
+	}
+
+	// nodes need CA certificates to verify peers, keys of CAs never leave CA store
+	var caFiles []string
+	written := make(map[string]bool)
+	for _, result := range results {
+		name := cfg.CAName(result.Spec.CA, caName)
+		if written[name] {
+			continue
+		}
+		written[name] = true
+		ca, err := loadSigningCA(cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		content := [][]byte{encodeCerts(ca.Chain.Intermediates...)}
+		if ca.Chain.Root != nil {
+			content = append(content, encodeCerts(ca.Chain.Root))
+		}
+		caFile := path.Join(bundleCADir, name+".crt")
+		if err := writeOutputFile(fs, outputDir, caFile, 0644, true, content...); err != nil {
+			return nil, err
+		}
+		caFiles = append(caFiles, caFile)
+	}
+	return caFiles, nil
+}
+
+// nodeBundleFile returns name of archive written for node by writeNodeBundles
+func nodeBundleFile(node string) string {
+	if node == "" {
+		node = masterBundleName
+	}
+	return node + ".tar.gz" + generator.EncryptedSuffix
+}
+
+// writeNodeBundles generates bundle in memory and writes files of every node to separate archive
+// encrypted to recipients of that node. Every archive also contains CA certificates and manifest of its files.
+// Nodes without recipients are skipped, their keys are never written unencrypted.
+func writeNodeBundles(cfg *Config, caName, outputDir string, opts signOptions, signer *manifestSigner) error {
+	files := generator.NewMemFS()
+	caFiles, err := writeBundle(cfg, caName, files, "", opts)
+	if err != nil {
+		return err
+	}
+	specs, err := cfg.CertSpecs()
+	if err != nil {
+		return err
+	}
+	var nodes []string
+	for _, spec := range specs {
+		if !containsString(nodes, spec.Node) {
+			nodes = append(nodes, spec.Node)
+		}
+	}
+
+	for _, node := range nodes {
+		target := path.Join(outputDir, nodeBundleFile(node))
+		recipients, err := generator.ParseRecipients(cfg.NodeRecipients(node))
+		if err != nil {
+			return err
+		}
+		if len(recipients) == 0 {
+			fmt.Printf("Node has no recipients, skipped: %v\n", target)
+			continue
+		}
+		node := node
+		manifest, err := buildManifest(cfg, files, &node, caFiles)
+		if err != nil {
+			return err
+		}
+		sink, err := generator.OpenSink(target, recipients, cfg.OverwriteFiles)
+		if err != nil {
+			return err
+		}
+		if err := copyManifestFiles(manifest, files, sink); err != nil {
+			sink.Close()
+			os.Remove(target)
+			return err
+		}
+		if err := writeManifest(manifest, signer, sink, target); err != nil {
+			sink.Close()
+			os.Remove(target)
+			return err
+		}
+		if err := sink.Close(); err != nil {
+			os.Remove(target)
+			return fmt.Errorf("failed to write %s: %v", target, err)
+		}
+		fmt.Printf("Archive created: %v (%d files, %d recipients)\n", target, len(manifest.Files), len(recipients))
+	}
+	return nil
+}
+
+// copyManifestFiles copies files listed in manifest keeping their permissions
+func copyManifestFiles(manifest *generator.Manifest, from *generator.MemFS, to generator.FS) error {
+	for _, entry := range manifest.Files {
+		content, err := from.ReadFile(entry.File)
+		if err != nil {
+			return err
+		}
+		if err := to.WriteFile(entry.File, content, from.Mode(entry.File)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var decryptCmd = cli.Command{
+	Name:      "decrypt",
+	Usage:     "Decrypt archive written by bundle and extract its files to output dir",
+	ArgsUsage: "<archive>",
+	Flags: []cli.Flag{
+		&identityFlag,
+		&passphraseFileFlag,
+		&outputDirFlag,
+	},
+	Before: initOutputDir,
+	Action: func(ctx *cli.Context) error {
+		if ctx.Args().Len() != 1 {
+			return fmt.Errorf("exactly one archive must be given")
+		}
+		var identities []age.Identity
+		for _, file := range ctx.StringSlice(identityFlag.Name) {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			parsed, err := generator.ParseIdentities(content)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", file, err)
+			}
+			identities = append(identities, parsed...)
+		}
+		if file := ctx.String(passphraseFileFlag.Name); file != "" {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			identity, err := age.NewScryptIdentity(strings.TrimRight(string(content), "\r\n"))
+			if err != nil {
+				return err
+			}
+			identities = append(identities, identity)
+		}
+		return decryptArchive(ctx.Args().First(), identities, ctx.App.Metadata[outputDirContextKey].(string))
+	},
+}
+
+// decryptArchive extracts archive to outputDir, archives with .age extension are decrypted with identities first
+func decryptArchive(file string, identities []age.Identity, outputDir string) error {
+	format, ok := generator.ArchiveFormatFromName(file)
+	if !ok {
+		return fmt.Errorf("%s: unknown archive format", file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(strings.ToLower(file), generator.EncryptedSuffix) {
+		if len(identities) == 0 {
+			return fmt.Errorf("%s is encrypted, use --%s or --%s", file, identityFlag.Name, passphraseFileFlag.Name)
+		}
+		if r, err = age.Decrypt(f, identities...); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %v", file, err)
+		}
+	}
+	names, err := generator.ExtractArchive(r, format, generator.DirFS(outputDir))
+	for _, name := range names {
+		fmt.Printf("File extracted: %v\n", path.Join(outputDir, name))
+	}
+	return err
+}
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
-	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"math/big"
 	"os"
 	"path"
 	"strings"
-	"time"
 
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"github.com/google/easypki/pkg/certificate"
 	"github.com/google/easypki/pkg/easypki"
 	"github.com/google/easypki/pkg/store"
 	"gopkg.in/urfave/cli.v2"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 var caNameFlag = cli.StringFlag{
@@ -41,18 +41,32 @@ var initCACmd = cli.Command{
 		return nil
 	},
 	Action: func(ctx *cli.Context) error {
-		return initCA(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string))
+		cfg, caName, outputDir := ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string)
+		if err := initCA(cfg, caName, outputDir); err != nil {
+			return err
+		}
+		// front proxy client certificate is never signed by main CA so its CA is created together with it
+		frontProxyCA := cfg.CAName(generator.CAFrontProxy, caName)
+		if frontProxyCA == caName || getCAStore(cfg, outputDir).Exists(frontProxyCA, frontProxyCA) {
+			return nil
+		}
+		return initCA(cfg, frontProxyCA, outputDir)
 	},
 }
 
 var signCommand = cli.Command{
 	Name:  "sign",
 	Usage: "Sign a certificate signing request",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&caNameFlag,
 		&configFlag,
 		&outputDirFlag,
-	},
+		&outputsFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+		&profileFlag,
+	}, outputSinkFlags...),
 	Before: func(ctx *cli.Context) error {
 		if err := initConfig(ctx); err != nil {
 			return err
@@ -60,10 +74,24 @@ var signCommand = cli.Command{
 		if err := initOutputDir(ctx); err != nil {
 			return err
 		}
+		for _, output := range ctx.StringSlice(outputsFlag.Name) {
+			if !isKnownOutput(output) {
+				return fmt.Errorf("unknown output %q, must be one of %v", output, knownOutputs)
+			}
+		}
 		return nil
 	},
 	Action: func(ctx *cli.Context) error {
-		return signCSRs(ctx.App.Metadata[configContextKey].(*Config), ctx.Args().Slice(), ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string))
+		opts := signOptions{
+			Outputs:        ctx.StringSlice(outputsFlag.Name),
+			PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+			PKCS12Password: passwordFromContext(ctx, true),
+			Profile:        ctx.String(profileFlag.Name),
+		}
+		return withOutputSink(ctx, func(sink generator.Sink, target string) error {
+			// CSRs and keys given on command line are read from disk
+			return signCSRsTo(ctx.App.Metadata[configContextKey].(*Config), generator.DirFS(""), ctx.Args().Slice(), ctx.String(caNameFlag.Name), sink, target, opts)
+		})
 	},
 }
 
@@ -72,90 +100,157 @@ func initCA(cfg *Config, caName string, outputDir string) error {
 	caStore := getCAStore(cfg, outputDir)
 
 	fmt.Println("Generate key/cert")
-	certParams, err := CertParamsFromConfig(cfg.CertConfig)
+	ca, err := generator.New(&cfg.Config, nil).InitCA(caName)
 	if err != nil {
 		return err
 	}
-	certParams.CommonFields = cfg.CAConfig.CommonFields
+	return caStore.Add(caName, caName, true, x509.MarshalPKCS1PrivateKey(ca.Key.(*rsa.PrivateKey)), ca.Cert.Raw)
+}
+
+func getCAStore(cfg *Config, outputDir string) *store.Local {
+	os.Mkdir(path.Join(outputDir, cfg.CAConfig.RootDir), os.ModePerm)
+	return &store.Local{Root: path.Join(outputDir, cfg.CAConfig.RootDir)}
+}
 
-	privateKey, err := certParams.GenKey()
+// signOptions contains sign parameters which are not stored in config
+type signOptions struct {
+	Outputs        []string // additional outputs for every signed certificate
+	Profile        string   // signing policy profile overriding one chosen by config
+	Operator       string   // user recorded in issuance log, current user if empty
+	PKCS12Encoder  *pkcs12.Encoder
+	PKCS12Password passwordSource
+}
+
+// signingCA is certificate authority loaded from store together with its chain
+type signingCA struct {
+	*certificate.Bundle
+	Chain *caChain
+}
+
+func (ca *signingCA) generatorCA(caName string) *generator.CA {
+	return &generator.CA{Name: caName, Cert: ca.Cert, Key: ca.Key}
+}
+
+func loadSigningCA(cfg *Config, caName string) (*signingCA, error) {
+	pki := easypki.EasyPKI{Store: getCAStore(cfg, "")}
+	bundle, err := pki.GetCA(caName)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to load certificate authority %s (use init-ca or import-ca to create it): %v", caName, err)
 	}
-
-	certTemplate := certParams.CACertTemplate()
-	cert, err := x509.CreateCertificate(rand.Reader, certTemplate, certTemplate, privateKey.Public(), privateKey)
+	chain, err := loadCAChain(cfg, caName, bundle)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &signingCA{Bundle: bundle, Chain: chain}, nil
+}
 
-	return caStore.Add(caName, caName, true, x509.MarshalPKCS1PrivateKey(privateKey), cert)
+// newGenerator returns generator writing files to fs which records issued certificates in CA index
+// and issuance log on behalf of operator
+func newGenerator(cfg *Config, fs generator.FS, operator string) *generator.Generator {
+	g := generator.New(&cfg.Config, fs)
+	g.SerialExists = func(ca *generator.CA, serial *big.Int) (bool, error) {
+		return isIndexed(cfg, ca.Name, serial)
+	}
+	if cfg.CAConfig.SerialMode == generator.SerialSequential {
+		g.NextSerial = func(ca *generator.CA) (*big.Int, error) {
+			return nextSequentialSerial(cfg, ca.Name)
+		}
+	}
+	g.OnIssued = func(issued *generator.Issued) error {
+		if err := recordIssued(cfg, issued.CA.Name, issued.Name, issued.Cert); err != nil {
+			return fmt.Errorf("failed to record certificate in %s index: %v", issued.CA.Name, err)
+		}
+		if err := appendIssuanceLog(cfg, issued.CA.Name, issuedLogEntry(issued, operator)); err != nil {
+			return fmt.Errorf("failed to record certificate in %s issuance log: %v", issued.CA.Name, err)
+		}
+		return nil
+	}
+	return g
 }
 
-func getCAStore(cfg *Config, outputDir string) *store.Local {
-	os.Mkdir(path.Join(outputDir, cfg.CAConfig.RootDir), os.ModePerm)
-	return &store.Local{Root: path.Join(outputDir, cfg.CAConfig.RootDir)}
+func signCSRs(cfg *Config, files []string, caName string, outputDir string, opts signOptions) error {
+	return signCSRsTo(cfg, generator.DirFS(""), files, caName, generator.DirFS(outputDir), outputDir, opts)
 }
 
-func signCSRs(cfg *Config, files []string, caName string, outputDir string) error {
-	pki := easypki.EasyPKI{Store: getCAStore(cfg, "")}
-	caSigner, err := pki.GetCA(caName)
-	if err != nil {
-		return err
+// signCSRsTo signs CSR files read from in together with their private keys and writes certificates to out.
+// outputDir is location of out shown in messages.
+func signCSRsTo(cfg *Config, in generator.FS, files []string, caName string, out generator.FS, outputDir string, opts signOptions) error {
+	signers := make(map[string]*signingCA)
+	g := newGenerator(cfg, out, opts.Operator)
+	g.LoadCA = func(name string) (*generator.CA, error) {
+		ca, ok := signers[name]
+		if !ok {
+			var err error
+			if ca, err = loadSigningCA(cfg, name); err != nil {
+				return nil, err
+			}
+			signers[name] = ca
+		}
+		return ca.generatorCA(name), nil
 	}
+
 	for _, file := range files {
 		fmt.Println("Signing", file)
-		content, err := ioutil.ReadFile(file)
+		content, err := in.ReadFile(file)
 		if err != nil {
 			return err
 		}
-		block, _ := pem.Decode(content)
-		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		csr, err := parseCSR(file, content)
 		if err != nil {
 			return err
 		}
 
-		if err = csr.CheckSignature(); err != nil {
-			return err
+		// certificates not described in config are signed for both server and client usage
+		name := strings.TrimSuffix(path.Base(file), path.Ext(file))
+		profile := opts.Profile
+		if profile == "" && cfg.Policy != nil {
+			profile = cfg.Policy.profileFor(name)
 		}
-
-		serial, err := rand.Int(rand.Reader, big.NewInt(big.MaxExp))
-		if err != nil {
-			return err
+		g.Authorize = func(name string, csr *x509.CertificateRequest, issue *generator.Issue) error {
+			decision, err := cfg.applyPolicy(profile, csr, issue.Validity)
+			if err != nil {
+				return fmt.Errorf("%s rejected by signing policy: %v", file, err)
+			}
+			if !decision.ProfileUsage {
+				decision.Usage = issue.Usage
+			}
+			decision.Extensions = generator.MergeExtensions(issue.Extensions, decision.Extensions)
+			*issue = decision.Issue
+			return nil
 		}
 
-		// step: create the request template
-		template := x509.Certificate{
-			SerialNumber:          serial,
-			Issuer:                caSigner.Cert.Subject,
-			Subject:               csr.Subject,
-			NotBefore:             time.Now().UTC(),
-			NotAfter:              time.Now().Add(cfg.ValidityPeriod.Duration).UTC(),
-			BasicConstraintsValid: true,
-			IsCA:        false,
-			KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-			IPAddresses: csr.IPAddresses,
-			DNSNames:    csr.DNSNames,
-		}
-
-		// step: sign the certificate authority
-		cert, err := x509.CreateCertificate(rand.Reader, &template, caSigner.Cert, csr.PublicKey, caSigner.Key)
-		if err != nil {
-			return fmt.Errorf("failed to generate certificate, error: %s", err)
-		}
-
-		certName := path.Join(outputDir, strings.TrimSuffix(path.Base(file), path.Ext(file))+".crt")
-		certFile, err := createFileIfNotExist(certName, cfg.OverwriteFiles)
+		result, err := g.Sign(caName, name, csr)
 		if err != nil {
 			return err
 		}
+		certName := path.Join(outputDir, result.CertFile)
+		if result.Skipped {
+			fmt.Printf("Cert exists, skipped: %v\n", certName)
+			continue
+		}
 		fmt.Printf("Cert created: %v\n", certName)
 
-		if err := pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert}); err != nil {
+		outputs := append(append([]string(nil), cfg.CertOutputs(name)...), opts.Outputs...)
+		outputOpts := certOutputOptions{
+			FS:             out,
+			Dir:            outputDir,
+			KeyFS:          in,
+			Overwrite:      cfg.OverwriteFiles,
+			Chain:          signers[result.CA.Name].Chain,
+			PKCS12Encoder:  opts.PKCS12Encoder,
+			PKCS12Password: opts.PKCS12Password,
+		}
+		if err := writeCertOutputs(outputs, name, keyFileForCSR(file), result.Cert, outputOpts); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// issueCert signs CSR with CA using values chosen by signing policy and records certificate in CA index
+func issueCert(cfg *Config, ca *signingCA, caName, name string, csr *x509.CertificateRequest, usage generator.CertUsage, decision *policyDecision, operator string) (*x509.Certificate, error) {
+	issue := decision.Issue
+	issue.Usage = usage
+	return newGenerator(cfg, nil, operator).IssueCert(ca.generatorCA(caName), name, csr, &issue)
+}
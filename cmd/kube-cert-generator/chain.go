@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"github.com/google/easypki/pkg/certificate"
+	"gopkg.in/urfave/cli.v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Additional files which can be written next to signed certificate
+const (
+	OutputChain     = "chain"     // <name>-chain.pem: certificate and intermediate CAs
+	OutputFullChain = "fullchain" // <name>-fullchain.pem: certificate, intermediate CAs and root CA
+	OutputCombined  = "combined"  // <name>.pem: certificate, intermediate CAs and private key
+	OutputPKCS12    = "p12"       // <name>.p12: PKCS#12 bundle with private key, certificate and CA chain
+)
+
+var knownOutputs = []string{OutputChain, OutputFullChain, OutputCombined, OutputPKCS12}
+
+var outputsFlag = cli.StringSliceFlag{
+	Name:  "outputs",
+	Usage: fmt.Sprintf("additional files to write for every signed certificate (%v)", knownOutputs),
+}
+
+func isKnownOutput(output string) bool {
+	for _, known := range knownOutputs {
+		if output == known {
+			return true
+		}
+	}
+	return false
+}
+
+// CertOutputs returns additional files which should be written for certificate with given name
+func (cfg *Config) CertOutputs(name string) []string {
+	if outputs, ok := cfg.CertOutputsByName[name]; ok {
+		return outputs
+	}
+	for _, extraCert := range cfg.ExtraCerts {
+		if extraCert.Name == name && len(extraCert.Outputs) > 0 {
+			return extraCert.Outputs
+		}
+	}
+	return cfg.Outputs
+}
+
+// caChain contains issuers of certificates signed by CA
+type caChain struct {
+	Intermediates []*x509.Certificate
+	CrossSigned   []*x509.Certificate // CA certificate issued by replaced CA until rotate-ca finish, see crossSignedCAFile
+	Root          *x509.Certificate   // may be nil if imported CA was given without root
+}
+
+// Issuers returns certificates sent together with certificate signed by CA. During CA rotation cross-signed
+// CA certificate is included so clients which trust only replaced CA can verify it.
+func (c *caChain) Issuers() []*x509.Certificate {
+	return append(append([]*x509.Certificate(nil), c.Intermediates...), c.CrossSigned...)
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// loadCAChain builds chain of CA using issuer certificates saved by import-ca
+func loadCAChain(cfg *Config, caName string, ca *certificate.Bundle) (*caChain, error) {
+	certs := []*x509.Certificate{ca.Cert}
+	content, err := ioutil.ReadFile(caChainFile(cfg, caName))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse CA chain: %v", err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	var ret caChain
+	if last := certs[len(certs)-1]; isSelfSigned(last) {
+		ret.Root = last
+		certs = certs[:len(certs)-1]
+	}
+	ret.Intermediates = certs
+
+	crossSignedFiles, err := filepath.Glob(crossSignedCAFile(cfg, caName, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range crossSignedFiles {
+		cert, err := readCertFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cross-signed CA certificate: %v", err)
+		}
+		ret.CrossSigned = append(ret.CrossSigned, cert)
+	}
+	return &ret, nil
+}
+
+func encodeCerts(certs ...*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// writeOutputFile writes file with given permissions to fs, existing file is kept unless overwrite is set.
+// Files holding private keys must be written with 0600. dir is only shown in messages.
+func writeOutputFile(fs generator.FS, dir, name string, perm os.FileMode, overwrite bool, content ...[]byte) error {
+	exists, err := fs.Exists(name)
+	if err != nil {
+		return err
+	}
+	if exists && !overwrite {
+		fmt.Printf("File exists, skipped: %v\n", path.Join(dir, name))
+		return nil
+	}
+	if err := fs.WriteFile(name, bytes.Join(content, nil), perm); err != nil {
+		return err
+	}
+	fmt.Printf("File created: %v\n", path.Join(dir, name))
+	return nil
+}
+
+// certOutputOptions configures writing of additional files for signed certificates
+type certOutputOptions struct {
+	FS             generator.FS // where files are written
+	Dir            string       // location of FS shown in messages
+	KeyFS          generator.FS // where private keys are read from
+	Overwrite      bool
+	Chain          *caChain
+	PKCS12Encoder  *pkcs12.Encoder
+	PKCS12Password passwordSource
+}
+
+// writeCertOutputs writes additional files for signed certificate. keyFile in opts.KeyFS is used for outputs which include private key.
+func writeCertOutputs(outputs []string, name string, keyFile string, cert *x509.Certificate, opts certOutputOptions) error {
+	overwrite, chain := opts.Overwrite, opts.Chain
+	leafChain := append([]*x509.Certificate{cert}, chain.Issuers()...)
+	written := make(map[string]bool)
+	for _, output := range outputs {
+		if written[output] {
+			continue
+		}
+		written[output] = true
+		switch output {
+		case OutputChain:
+			if err := writeOutputFile(opts.FS, opts.Dir, name+"-chain.pem", 0644, overwrite, encodeCerts(leafChain...)); err != nil {
+				return err
+			}
+		case OutputFullChain:
+			if chain.Root == nil {
+				return fmt.Errorf("root CA is unknown, cannot create %s-fullchain.pem", name)
+			}
+			if err := writeOutputFile(opts.FS, opts.Dir, name+"-fullchain.pem", 0644, overwrite, encodeCerts(append(leafChain, chain.Root)...)); err != nil {
+				return err
+			}
+		case OutputCombined:
+			key, err := opts.KeyFS.ReadFile(keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to read private key for %s.pem: %v", name, err)
+			}
+			if err := writeOutputFile(opts.FS, opts.Dir, name+".pem", 0600, overwrite, encodeCerts(leafChain...), key); err != nil {
+				return err
+			}
+		case OutputPKCS12:
+			if opts.PKCS12Password == nil {
+				return fmt.Errorf("password for %s.p12 is not provided", name)
+			}
+			if opts.PKCS12Encoder == nil {
+				opts.PKCS12Encoder = pkcs12Encoder(false)
+			}
+			if err := writePKCS12(name, keyFile, cert, opts); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown output %q", output)
+		}
+	}
+	return nil
+}
+
+// keyFileForCSR returns path of private key written by gen-csr together with CSR
+func keyFileForCSR(csrFile string) string {
+	return strings.TrimSuffix(csrFile, path.Ext(csrFile)) + ".key"
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
-	"time"
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 
-	"github.com/containerum/kube-cert-generator/pkg/cert"
+	"github.com/BurntSushi/toml"
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -11,56 +21,269 @@ const (
 	outputDirContextKey = "output"
 )
 
-func CertParamsFromConfig(cfg CertConfig) (cert.Params, error) {
-	ret := cert.Params{
-		ValidityPeriod: cfg.ValidityPeriod.Duration,
-		KeySize:        cfg.KeySize,
-	}
+// Duration is written in config as string, e.g. "8760h"
+type Duration = generator.Duration
+
+// Config represents app configuration. Certificates are described by embedded generator config,
+// other sections configure commands.
+type Config struct {
+	generator.Config `yaml:",inline"`
+	Policy           *SigningPolicy `toml:"policy" yaml:"policy" json:"policy"`
+	API              APIConfig      `toml:"api" yaml:"api" json:"api"`
+	Renewal          RenewalConfig  `toml:"renewal" yaml:"renewal" json:"renewal"`
 
-	return ret, nil
+	CertOutputsByName map[string][]string `toml:"cert_outputs" yaml:"cert_outputs" json:"cert_outputs"`
 }
 
-type Duration struct {
-	time.Duration
+// LoadConfig reads config from file. Format is chosen by file extension: TOML (default), YAML or JSON.
+// Keys present in file but not known by Config are returned as dotted paths.
+func LoadConfig(file string) (*Config, []string, error) {
+	var cfg Config
+	var unknownKeys []string
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml", ".json":
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		var raw interface{}
+		if strings.ToLower(filepath.Ext(file)) == ".json" {
+			err = json.Unmarshal(content, &cfg)
+			if err == nil {
+				err = json.Unmarshal(content, &raw)
+			}
+		} else {
+			err = yaml.Unmarshal(content, &cfg)
+			if err == nil {
+				err = yaml.Unmarshal(content, &raw)
+			}
+		}
+		if err != nil {
+			if strings.ToLower(filepath.Ext(file)) == ".json" {
+				json.Unmarshal(content, &raw)
+			} else {
+				yaml.Unmarshal(content, &raw)
+			}
+			return nil, nil, parseError(file, raw, err)
+		}
+		unknownKeys = findUnknownKeys(raw, reflect.TypeOf(cfg), "")
+	default:
+		md, err := toml.DecodeFile(file, &cfg)
+		if err != nil {
+			var raw map[string]interface{}
+			toml.DecodeFile(file, &raw)
+			return nil, nil, parseError(file, raw, err)
+		}
+		for _, key := range md.Undecoded() {
+			unknownKeys = append(unknownKeys, key.String())
+		}
+	}
+	return &cfg, unknownKeys, nil
 }
 
-func (d *Duration) UnmarshalText(text []byte) error {
+// SaveConfig writes config to file in format chosen by file extension like LoadConfig does.
+// Comments present in original file are not preserved.
+func SaveConfig(cfg *Config, file string) error {
+	var content []byte
 	var err error
-	d.Duration, err = time.ParseDuration(string(text))
-	return err
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		content, err = yaml.Marshal(cfg)
+	case ".json":
+		content, err = json.MarshalIndent(cfg, "", "  ")
+	default:
+		// toml encoder can not walk nested embedded structs so config is encoded as generic document
+		var raw interface{}
+		if raw, err = configDocument(cfg); err == nil {
+			var buf bytes.Buffer
+			err = toml.NewEncoder(&buf).Encode(raw)
+			content = buf.Bytes()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	return ioutil.WriteFile(file, content, 0644)
 }
 
-// CertConfig represents certificate creation configuration
-type CertConfig struct {
-	ValidityPeriod Duration `toml:"validity_period"`
-	KeySize        int      `toml:"key_size"`
+// configValuesError is returned by LoadConfig for config with values which can not be parsed
+type configValuesError struct {
+	File     string
+	Problems []ConfigProblem
 }
 
-// ExtraCertConfig represents configuration for creating additional certs
-type ExtraCertConfig struct {
-	Name string `toml:"name"`
+func (e *configValuesError) Error() string {
+	var problems []string
+	for _, problem := range e.Problems {
+		problems = append(problems, problem.String())
+	}
+	return fmt.Sprintf("failed to parse %s: %s", e.File, strings.Join(problems, "; "))
+}
 
-	cert.CommonFields
-	CertConfig
-	Host cert.Host `toml:"host"`
+// parseError returns error of config decoding. Decoders do not report where value they failed to parse is,
+// so decoded document is searched for such values to report them with key paths.
+func parseError(file string, raw interface{}, err error) error {
+	if invalid := findInvalidValues(raw, reflect.TypeOf(Config{}), ""); len(invalid) > 0 {
+		return &configValuesError{File: file, Problems: invalid}
+	}
+	return fmt.Errorf("failed to parse %s: %v", file, err)
 }
 
-// CAConfig represents configuration for certificate authority
-type CAConfig struct {
-	RootDir string `toml:"root_dir"`
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 
-	cert.CommonFields
-	CertConfig
+// findInvalidValues walks decoded document like findUnknownKeys and returns problems of string values
+// which config types fail to parse.
+func findInvalidValues(raw interface{}, typ reflect.Type, path string) []ConfigProblem {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if text, ok := raw.(string); ok && reflect.PtrTo(typ).Implements(textUnmarshalerType) {
+		if err := reflect.New(typ).Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text)); err != nil {
+			return []ConfigProblem{{Path: path, Message: err.Error()}}
+		}
+		return nil
+	}
+	var ret []ConfigProblem
+	walkField := func(key string, item interface{}) {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		switch typ.Kind() {
+		case reflect.Map:
+			ret = append(ret, findInvalidValues(item, typ.Elem(), keyPath)...)
+		case reflect.Struct:
+			if field, ok := fieldByKey(typ, key); ok {
+				ret = append(ret, findInvalidValues(item, field.Type, keyPath)...)
+			}
+		}
+	}
+	switch value := raw.(type) {
+	case []interface{}:
+		if typ.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, item := range value {
+			ret = append(ret, findInvalidValues(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		if typ.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, item := range value {
+			ret = append(ret, findInvalidValues(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case map[string]interface{}:
+		for key, item := range value {
+			walkField(key, item)
+		}
+	case map[interface{}]interface{}:
+		for key, item := range value {
+			walkField(fmt.Sprint(key), item)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret
 }
 
-// Config represents app configuration
-type Config struct {
-	CommonFields   cert.CommonFields `toml:"common_fields"`
-	OverwriteFiles bool              `toml:"overwrite_files"`
-	CertConfig
-	MasterNode  cert.Host         `toml:"master_node"`
-	WorkerNodes []cert.Host       `toml:"worker_node"`
-	EtcdNodes   []cert.Host       `toml:"etcd_node"`
-	ExtraCerts  []ExtraCertConfig `toml:"extra_cert"`
-	CAConfig    CAConfig          `toml:"ca"`
+// configDocument converts config to maps and slices keyed by config keys. Null values are omitted.
+func configDocument(cfg *Config) (interface{}, error) {
+	content, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return normalizeDocument(raw), nil
+}
+
+func normalizeDocument(raw interface{}) interface{} {
+	switch value := raw.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			if item == nil {
+				delete(value, key)
+				continue
+			}
+			value[key] = normalizeDocument(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeDocument(item)
+		}
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		n, _ := value.Float64()
+		return n
+	}
+	return raw
+}
+
+// findUnknownKeys walks decoded YAML or JSON document and returns keys which have no corresponding struct field.
+func findUnknownKeys(raw interface{}, typ reflect.Type, path string) []string {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	var ret []string
+	switch value := raw.(type) {
+	case []interface{}:
+		if typ.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, item := range value {
+			ret = append(ret, findUnknownKeys(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case map[string]interface{}:
+		for key, item := range value {
+			ret = append(ret, findUnknownKeysInField(key, item, typ, path)...)
+		}
+	case map[interface{}]interface{}:
+		for key, item := range value {
+			ret = append(ret, findUnknownKeysInField(fmt.Sprint(key), item, typ, path)...)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func findUnknownKeysInField(key string, raw interface{}, typ reflect.Type, path string) []string {
+	keyPath := key
+	if path != "" {
+		keyPath = path + "." + key
+	}
+	if typ.Kind() == reflect.Map {
+		return findUnknownKeys(raw, typ.Elem(), keyPath)
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil
+	}
+	field, ok := fieldByKey(typ, key)
+	if !ok {
+		return []string{keyPath}
+	}
+	return findUnknownKeys(raw, field.Type, keyPath)
+}
+
+// fieldByKey looks up struct field by its config key, descending into embedded structs.
+func fieldByKey(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous && field.Tag.Get("toml") == "" {
+			if ret, ok := fieldByKey(field.Type, key); ok {
+				return ret, true
+			}
+			continue
+		}
+		if field.Tag.Get("toml") == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
 }
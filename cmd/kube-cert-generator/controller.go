@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/csrsigner"
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+var (
+	signerNameFlag = cli.StringFlag{
+		Name:  "signer-name",
+		Usage: "spec.signerName of CertificateSigningRequests signed by controller",
+		Value: "containerum.com/kube-cert-generator",
+	}
+	syncIntervalFlag = cli.DurationFlag{
+		Name:  "interval",
+		Usage: "interval between CertificateSigningRequest list calls",
+		Value: 30 * time.Second,
+	}
+	apiserverFlag = cli.StringFlag{
+		Name:  "apiserver",
+		Usage: "Kubernetes API server URL, service account of pod is used if not set",
+	}
+	apiserverTokenFileFlag = cli.StringFlag{
+		Name:  "token-file",
+		Usage: "bearer token file for --apiserver",
+	}
+	apiserverCAFlag = cli.StringFlag{
+		Name:  "apiserver-ca",
+		Usage: "CA certificate file for --apiserver, system roots are used if not set",
+	}
+	onceFlag = cli.BoolFlag{
+		Name:  "once",
+		Usage: "do single pass and exit",
+	}
+)
+
+var controllerCmd = cli.Command{
+	Name:  "controller",
+	Usage: "Sign approved Kubernetes CertificateSigningRequests addressed to signer name",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&signerNameFlag,
+		&profileFlag,
+		&syncIntervalFlag,
+		&apiserverFlag,
+		&apiserverTokenFileFlag,
+		&apiserverCAFlag,
+		&onceFlag,
+	},
+	Before: initConfig,
+	Action: func(ctx *cli.Context) error {
+		var client csrsigner.Client
+		var err error
+		if server := ctx.String(apiserverFlag.Name); server != "" {
+			client, err = csrsigner.NewRESTClient(server, ctx.String(apiserverTokenFileFlag.Name), ctx.String(apiserverCAFlag.Name))
+		} else {
+			client, err = csrsigner.NewInClusterClient()
+		}
+		if err != nil {
+			return err
+		}
+		cfg, caName := ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name)
+		signer, err := newClusterSigner(cfg, caName, ctx.String(profileFlag.Name))
+		if err != nil {
+			return err
+		}
+		controller := &csrsigner.Controller{
+			Client:     client,
+			SignerName: ctx.String(signerNameFlag.Name),
+			Signer:     signer,
+			Interval:   ctx.Duration(syncIntervalFlag.Name),
+			Logf:       log.Printf,
+		}
+		if ctx.Bool(onceFlag.Name) {
+			result, err := controller.Sync(context.Background())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Signed %d, rejected %d, failed to handle %d\n", result.Signed, result.Rejected, result.Errors)
+			if result.Errors > 0 {
+				return fmt.Errorf("failed to handle %d request(s)", result.Errors)
+			}
+			return nil
+		}
+
+		runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Printf("Sign CertificateSigningRequests for %s with certificate authority %s\n", controller.SignerName, caName)
+		if err := controller.Run(runCtx); err != context.Canceled {
+			return err
+		}
+		return nil
+	},
+}
+
+// clusterSigner signs Kubernetes CSRs with CA from store applying signing policy
+type clusterSigner struct {
+	cfg     *Config
+	caName  string
+	ca      *signingCA
+	profile string
+	mu      sync.Mutex // serializes writes to CA index
+}
+
+func newClusterSigner(cfg *Config, caName, profile string) (*clusterSigner, error) {
+	if cfg.Policy == nil {
+		return nil, fmt.Errorf("controller requires signing policy in config")
+	}
+	if profile == "" {
+		profile = cfg.Policy.DefaultProfile
+	}
+	if _, ok := cfg.Policy.Profiles[profile]; !ok {
+		return nil, fmt.Errorf("unknown signing profile %q, set policy default_profile or use --%s", profile, profileFlag.Name)
+	}
+	ca, err := loadSigningCA(cfg, caName)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterSigner{cfg: cfg, caName: caName, ca: ca, profile: profile}, nil
+}
+
+// csrUsage converts key usages requested in Kubernetes CSR
+func csrUsage(usages []string) (generator.CertUsage, error) {
+	server, client := false, false
+	for _, usage := range usages {
+		switch usage {
+		case csrsigner.UsageDigitalSignature, csrsigner.UsageKeyEncipherment:
+		case csrsigner.UsageServerAuth:
+			server = true
+		case csrsigner.UsageClientAuth:
+			client = true
+		default:
+			return 0, fmt.Errorf("usage %q is not supported", usage)
+		}
+	}
+	switch {
+	case server && client:
+		return generator.UsageServerClient, nil
+	case server:
+		return generator.UsageServer, nil
+	case client:
+		return generator.UsageClient, nil
+	default:
+		return 0, fmt.Errorf("%q or %q usage is required", csrsigner.UsageServerAuth, csrsigner.UsageClientAuth)
+	}
+}
+
+func (s *clusterSigner) Sign(csr *csrsigner.CertificateSigningRequest, req *x509.CertificateRequest) ([]byte, error) {
+	usage, err := csrUsage(csr.Spec.Usages)
+	if err != nil {
+		return nil, csrsigner.Reject("UnsupportedUsage", "%v", err)
+	}
+	validity := s.cfg.ValidityPeriod.Duration
+	if expiration := csr.Expiration(); expiration > 0 && expiration < validity {
+		validity = expiration
+	}
+	decision, err := s.cfg.Policy.apply(s.profile, req, validity)
+	if err != nil {
+		return nil, csrsigner.Reject("SigningPolicy", "rejected by signing policy: %v", err)
+	}
+	for _, note := range decision.Notes {
+		log.Printf("%s: policy: %s", csr.Metadata.Name, note)
+	}
+	if decision.ProfileUsage {
+		usage = decision.Usage
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cert, err := issueCert(s.cfg, s.ca, s.caName, "k8s:"+csr.Metadata.Name, req, usage, decision, csr.Spec.Username)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s: issued %q requested by %s, serial %s", csr.Metadata.Name, cert.Subject, csr.Spec.Username, indexSerial(cert.SerialNumber))
+	return encodeCerts(append([]*x509.Certificate{cert}, s.ca.Chain.Issuers()...)...), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+
+	"github.com/containerum/kube-cert-generator/pkg/csrsigner"
+)
+
+func TestControllerLeavesCSRViolatingSigningPolicyUnsigned(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "admin", Organization: []string{"system:masters"}},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := csrsigner.CertificateSigningRequest{
+		Metadata: csrsigner.ObjectMeta{Name: "escalation"},
+		Spec: csrsigner.CertificateSigningRequestSpec{
+			Request:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+			SignerName: signerNameFlag.Value,
+			Usages:     []string{csrsigner.UsageClientAuth},
+		},
+		Status: csrsigner.CertificateSigningRequestStatus{
+			Conditions: []csrsigner.CertificateSigningRequestCondition{{Type: csrsigner.ConditionApproved, Status: "True"}},
+		},
+	}
+
+	// request is rejected before CA is used, so signer works without CA store
+	cfg := &Config{Policy: &SigningPolicy{Profiles: map[string]SigningProfile{
+		"node": {CommonNames: []string{"system:node:.+"}, Organizations: []string{"system:nodes"}},
+	}}}
+	client := csrsigner.NewFakeClient(csr)
+	controller := &csrsigner.Controller{
+		Client:     client,
+		SignerName: signerNameFlag.Value,
+		Signer:     &clusterSigner{cfg: cfg, caName: "root", profile: "node"},
+	}
+	result, err := controller.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (csrsigner.SyncResult{Rejected: 1}) {
+		t.Errorf("sync result %+v, expected one rejected", result)
+	}
+	stored, _ := client.Get("escalation")
+	if len(stored.Status.Certificate) > 0 {
+		t.Error("certificate is written for CSR violating signing policy")
+	}
+	conditions := stored.Status.Conditions
+	if last := conditions[len(conditions)-1]; last.Type != csrsigner.ConditionFailed || last.Reason != "SigningPolicy" {
+		t.Errorf("last condition %+v, expected Failed with SigningPolicy reason", last)
+	}
+}
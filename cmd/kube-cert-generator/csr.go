@@ -1,164 +1,53 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"path"
-	"reflect"
 
-	"github.com/containerum/kube-cert-generator/pkg/cert"
+	"github.com/containerum/kube-cert-generator/pkg/generator"
 	"gopkg.in/urfave/cli.v2"
 )
 
-type csrParams struct {
-	FileName    string
-	CN          string
-	O           string
-	IncludeSANs bool
-	DNSNames    []string
-}
-
-func (c csrParams) String() string {
-	return fmt.Sprintf("File: %s, CN=%s, O=%s%s", c.FileName, c.CN, c.O, func() string {
-		if c.IncludeSANs {
-			return " with SANs"
-		}
-		return ""
-	}())
-}
-
-var kubeStandardCSRs = []csrParams{
-	{FileName: "admin", CN: "admin", O: "system:masters", IncludeSANs: false},
-	{FileName: "kube-controller-manager", CN: "system:kube-controller-manager", O: "system:kube-controller-manager", IncludeSANs: false},
-	{FileName: "kube-proxy", CN: "system:kube-proxy", O: "system:node-proxier", IncludeSANs: false},
-	{FileName: "kubernetes", CN: "kubernetes", O: "kubernetes", IncludeSANs: true, DNSNames: []string{"kubernetes", "kubernetes.default", "kubernetes.default.svc", "kubernetes.default.svc.cluster.local"}},
-	{FileName: "kube-scheduler", CN: "system:kube-scheduler", O: "system:kube-scheduler", IncludeSANs: false},
-	{FileName: "service-account", CN: "service-accounts", O: "Kubernetes", IncludeSANs: false},
-}
-
-func outputKeyCSR(fileName string, dirPath string, overwriteFiles bool, certParam cert.Params) error {
-	fileName = path.Join(dirPath, fileName)
-
-	key, err := certParam.GenKey()
-	if err != nil {
-		return err
-	}
-	keyFile, err := createFileIfNotExist(fileName+".key", overwriteFiles)
-	if err != nil {
-		return err
-	}
-	fmt.Printf("KEY file: %v.key\n", fileName)
-	if err := pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
-		return nil
-	}
-	csr, err := x509.CreateCertificateRequest(rand.Reader, certParam.CSRTemplate(), key)
-	if err != nil {
-		return err
+// printCSRResult reports files written for certificate
+func printCSRResult(outputDir string, result *generator.CSRResult) {
+	fmt.Println(result.Spec)
+	switch {
+	case !result.KeyCreated && !result.CSRCreated:
+		fmt.Printf("Key and CSR exist, skipped: %v\n", path.Join(outputDir, result.CSRFile))
+	case !result.KeyCreated:
+		fmt.Printf("KEY file exists: %v\n", path.Join(outputDir, result.KeyFile))
+	default:
+		fmt.Printf("KEY file: %v\n", path.Join(outputDir, result.KeyFile))
 	}
-	csrFile, err := createFileIfNotExist(fileName+".csr", overwriteFiles)
-	if err := pem.Encode(csrFile, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}); err != nil {
-		return err
+	if result.CSRCreated {
+		fmt.Printf("CSR file: %v\n", path.Join(outputDir, result.CSRFile))
 	}
-	fmt.Printf("CSR file: %v.csr\n", fileName)
 	fmt.Println()
-	return nil
 }
 
-func generateCSRs(cfg *Config, ourDir string) error {
+// generateCSRs writes keys and CSRs to fs, outputDir is location of fs shown in messages
+func generateCSRs(cfg *Config, fs generator.FS, outputDir string) ([]generator.CSRResult, error) {
 	fmt.Println("Generate pairs of private keys and certificate signing requests")
 
-	fmt.Println("Generate basic kubernetes csr-key pairs")
-	for _, param := range kubeStandardCSRs {
-		fmt.Println(param)
-		certParam, err := CertParamsFromConfig(cfg.CertConfig)
-		if err != nil {
-			return err
-		}
-		if param.IncludeSANs {
-			certParam.SubjectAdditionalNames = cfg.MasterNode.ToSANs()
-		}
-		if len(param.DNSNames) > 0 {
-			certParam.DNSNames = append(certParam.DNSNames, param.DNSNames...)
-		}
-
-		certParam.CommonFields = cfg.CommonFields
-		certParam.Organization = []string{param.O}
-		certParam.CommonName = param.CN
-
-		if err := outputKeyCSR(param.FileName, ourDir, cfg.OverwriteFiles, certParam); err != nil {
-			return err
-		}
-	}
-
-	fmt.Println("Generate node certificates")
-	for _, node := range cfg.WorkerNodes {
-		fmt.Printf("Node: %s, Addresses: %v\n", node.Alias, node.Addresses)
-		certParam, err := CertParamsFromConfig(cfg.CertConfig)
-		if err != nil {
-			return err
-		}
-		certParam.SubjectAdditionalNames = node.ToSANs()
-		certParam.CommonFields = cfg.CommonFields
-		certParam.Organization = []string{"system:nodes"}
-		certParam.CommonName = fmt.Sprintf("system:node:%s", node.Alias)
-
-		if err := outputKeyCSR(node.Alias, ourDir, cfg.OverwriteFiles, certParam); err != nil {
-			return err
-		}
-	}
-
-	fmt.Println("Generate etcd certificates")
-	for _, node := range cfg.EtcdNodes {
-		fmt.Printf("Node: %s, Addresses: %v\n", node.Alias, node.Addresses)
-		certParam, err := CertParamsFromConfig(cfg.CertConfig)
-		if err != nil {
-			return err
-		}
-		certParam.SubjectAdditionalNames = node.ToSANs()
-		certParam.CommonFields = cfg.CommonFields
-		certParam.Organization = []string{"system:etcd"}
-		certParam.CommonName = fmt.Sprintf("system:ectd:%s", node.Alias)
-
-		if err := outputKeyCSR(node.Alias, ourDir, cfg.OverwriteFiles, certParam); err != nil {
-			return err
+	results, err := generator.New(&cfg.Config, fs).GenerateCSRs()
+	var group string
+	for i := range results {
+		if results[i].Spec.Group != group {
+			group = results[i].Spec.Group
+			fmt.Printf("Generate %s certificates\n", group)
 		}
+		printCSRResult(outputDir, &results[i])
 	}
-
-	fmt.Println("Generate extra certs")
-	for _, extraCert := range cfg.ExtraCerts {
-		fmt.Printf("Name: %s, Node: %s, Addresses: %v\n", extraCert.Name, extraCert.Host.Alias, extraCert.Host.Addresses)
-		certParam, err := CertParamsFromConfig(extraCert.CertConfig)
-		if err != nil {
-			return err
-		}
-
-		certParam.CommonFields = cfg.CommonFields
-		certParam.SubjectAdditionalNames = extraCert.Host.ToSANs()
-
-		str1, str2 := reflect.ValueOf(&certParam.CommonFields), reflect.ValueOf(&extraCert.CommonFields)
-		for i := 0; i < str1.Elem().NumField(); i++ {
-			if str2.Elem().Field(i).Len() > 0 {
-				str1.Elem().Field(i).Set(str2.Elem().Field(i))
-			}
-		}
-
-		if err := outputKeyCSR(extraCert.Name, ourDir, cfg.OverwriteFiles, certParam); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return results, err
 }
 
 var generateCSRsCmd = cli.Command{
 	Name:  "gen-csr",
 	Usage: "Generate private key and certificate signing requests using config",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&configFlag,
 		&outputDirFlag,
-	},
+	}, outputSinkFlags...),
 	Before: func(ctx *cli.Context) error {
 		if err := initConfig(ctx); err != nil {
 			return err
@@ -169,6 +58,9 @@ var generateCSRsCmd = cli.Command{
 		return nil
 	},
 	Action: func(ctx *cli.Context) error {
-		return generateCSRs(ctx.App.Metadata[configContextKey].(*Config), ctx.App.Metadata[outputDirContextKey].(string))
+		return withOutputSink(ctx, func(sink generator.Sink, target string) error {
+			_, err := generateCSRs(ctx.App.Metadata[configContextKey].(*Config), sink, target)
+			return err
+		})
 	},
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// Request headers used by apiserver to pass authenticated user to aggregated API servers
+const (
+	requestHeaderUsername    = "X-Remote-User"
+	requestHeaderGroup       = "X-Remote-Group"
+	requestHeaderExtraPrefix = "X-Remote-Extra-"
+)
+
+// caCertFile returns path of CA certificate in CA store
+func caCertFile(cfg *Config, caName string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "certs", caName+".crt")
+}
+
+// commandLineFlag is a single kube-apiserver command line flag
+type commandLineFlag struct {
+	Name  string
+	Value string
+}
+
+func (f commandLineFlag) String() string {
+	return fmt.Sprintf("--%s=%s", f.Name, f.Value)
+}
+
+// apiserverFlags returns kube-apiserver flags referring to certificates generated for config.
+// certDir is directory with signed certificates and keys.
+func apiserverFlags(cfg *Config, caName, certDir string) []commandLineFlag {
+	certFile := func(name, ext string) string {
+		return filepath.Join(certDir, name+ext)
+	}
+	ret := []commandLineFlag{
+		{Name: "client-ca-file", Value: caCertFile(cfg, caName)},
+		{Name: "tls-cert-file", Value: certFile("kubernetes", ".crt")},
+		{Name: "tls-private-key-file", Value: certFile("kubernetes", ".key")},
+		{Name: "service-account-key-file", Value: certFile("service-account", ".crt")},
+		{Name: "kubelet-certificate-authority", Value: caCertFile(cfg, caName)},
+	}
+	if len(cfg.EtcdNodes) > 0 {
+		ret = append(ret,
+			commandLineFlag{Name: "etcd-cafile", Value: caCertFile(cfg, cfg.CAName(generator.CAEtcd, caName))},
+			commandLineFlag{Name: "etcd-certfile", Value: certFile("apiserver-etcd-client", ".crt")},
+			commandLineFlag{Name: "etcd-keyfile", Value: certFile("apiserver-etcd-client", ".key")},
+		)
+	}
+	ret = append(ret,
+		commandLineFlag{Name: "requestheader-client-ca-file", Value: caCertFile(cfg, cfg.CAName(generator.CAFrontProxy, caName))},
+		commandLineFlag{Name: "requestheader-allowed-names", Value: generator.FrontProxyClientName},
+		commandLineFlag{Name: "requestheader-username-headers", Value: requestHeaderUsername},
+		commandLineFlag{Name: "requestheader-group-headers", Value: requestHeaderGroup},
+		commandLineFlag{Name: "requestheader-extra-headers-prefix", Value: requestHeaderExtraPrefix},
+		commandLineFlag{Name: "proxy-client-cert-file", Value: certFile(generator.FrontProxyClientName, ".crt")},
+		commandLineFlag{Name: "proxy-client-key-file", Value: certFile(generator.FrontProxyClientName, ".key")},
+	)
+	return ret
+}
+
+var apiserverFlagsCmd = cli.Command{
+	Name:  "apiserver-flags",
+	Usage: "Print kube-apiserver flags for certificates generated with config",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&inputDirFlag,
+	},
+	Before: initConfig,
+	Action: func(ctx *cli.Context) error {
+		for _, flag := range apiserverFlags(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.String(inputDirFlag.Name)) {
+			fmt.Println(flag)
+		}
+		return nil
+	},
+}
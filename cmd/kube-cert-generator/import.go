@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	caCertFileFlag = cli.StringFlag{
+		Name:  "cert",
+		Usage: "path to CA certificate (PEM, DER or PKCS#12 bundle)",
+	}
+	caKeyFileFlag = cli.StringFlag{
+		Name:  "key",
+		Usage: "path to CA private key (PEM or DER, PKCS#1 or PKCS#8, RSA only), not needed if it is included to cert file",
+	}
+)
+
+var importCACmd = cli.Command{
+	Name:  "import-ca",
+	Usage: "Import existing certificate authority with RSA key to use it for signing",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&caCertFileFlag,
+		&caKeyFileFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if ctx.String(caCertFileFlag.Name) == "" {
+			return fmt.Errorf("--%s must be specified", caCertFileFlag.Name)
+		}
+		return initConfig(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		bundle, err := readCABundle(ctx.String(caCertFileFlag.Name), ctx.String(caKeyFileFlag.Name), passwordFromContext(ctx, false))
+		if err != nil {
+			return err
+		}
+		return importCA(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), bundle)
+	},
+}
+
+// caBundle contains parsed CA material read from user-provided files
+type caBundle struct {
+	Cert  *x509.Certificate
+	Key   crypto.PrivateKey
+	Chain []*x509.Certificate // issuers of Cert, if Cert is not self-signed
+}
+
+func isPKCS12File(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".p12", ".pfx":
+		return true
+	}
+	return false
+}
+
+func readCABundle(certFile, keyFile string, password passwordSource) (*caBundle, error) {
+	var bundle caBundle
+	content, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if isPKCS12File(certFile) {
+		pass, err := password()
+		if err != nil {
+			return nil, err
+		}
+		var caCerts []*x509.Certificate
+		bundle.Key, bundle.Cert, caCerts, err = pkcs12.DecodeChain(content, pass)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode PKCS#12 bundle %s: %v", certFile, err)
+		}
+		bundle.Chain = caCerts
+	} else {
+		certs, key, err := parseCertsAndKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", certFile, err)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("no certificates found in %s", certFile)
+		}
+		bundle.Cert, bundle.Chain, bundle.Key = certs[0], certs[1:], key
+	}
+
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if _, bundle.Key, err = parseCertsAndKey(content); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", keyFile, err)
+		}
+	}
+	if bundle.Key == nil {
+		return nil, errors.New("private key not found, specify it using --key")
+	}
+	return &bundle, nil
+}
+
+// parseCertsAndKey reads certificates and private key from PEM or DER encoded data
+func parseCertsAndKey(content []byte) (certs []*x509.Certificate, key crypto.PrivateKey, err error) {
+	if !bytes.Contains(content, []byte("-----BEGIN")) {
+		if cert, err := x509.ParseCertificate(content); err == nil {
+			return []*x509.Certificate{cert}, nil, nil
+		}
+		// generator parses only PEM, so raw DER key is wrapped into PEM block
+		signer, err := generator.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: content}))
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, signer, nil
+	}
+
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			signer, err := generator.ParsePrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, nil, err
+			}
+			key = signer
+		}
+	}
+	return certs, key, nil
+}
+
+func (b *caBundle) verify() error {
+	if !b.Cert.BasicConstraintsValid || !b.Cert.IsCA {
+		return errors.New("certificate is not a CA certificate")
+	}
+	if b.Cert.KeyUsage != 0 && b.Cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("certificate key usage does not allow signing certificates")
+	}
+	if now := time.Now(); now.Before(b.Cert.NotBefore) || now.After(b.Cert.NotAfter) {
+		return fmt.Errorf("certificate is valid only from %v to %v", b.Cert.NotBefore, b.Cert.NotAfter)
+	}
+	signer, ok := b.Key.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	if pub, ok := signer.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	}); !ok || !pub.Equal(b.Cert.PublicKey) {
+		return errors.New("private key does not match certificate")
+	}
+	chain, err := orderChain(b.Cert, b.Chain)
+	if err != nil {
+		return err
+	}
+	b.Chain = chain
+	return nil
+}
+
+// orderChain sorts issuer certificates so each of them signs the previous one
+func orderChain(cert *x509.Certificate, issuers []*x509.Certificate) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	remaining := append([]*x509.Certificate(nil), issuers...)
+	for child := cert; len(remaining) > 0; {
+		found := -1
+		for i, issuer := range remaining {
+			if bytes.Equal(child.RawIssuer, issuer.RawSubject) && child.CheckSignatureFrom(issuer) == nil {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return nil, fmt.Errorf("issuer of %q not found in provided chain", child.Subject)
+		}
+		child = remaining[found]
+		chain = append(chain, child)
+		remaining = append(remaining[:found], remaining[found+1:]...)
+	}
+	return chain, nil
+}
+
+// caChainFile returns path of file which contains issuers of imported intermediate CA
+func caChainFile(cfg *Config, caName string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "chain.pem")
+}
+
+// keyTypeName returns name of private key algorithm for error messages
+func keyTypeName(key crypto.PrivateKey) string {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		return "ECDSA"
+	case ed25519.PrivateKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+func importCA(cfg *Config, caName string, bundle *caBundle) error {
+	fmt.Println("Import certificate authority", bundle.Cert.Subject, "to", path.Join(cfg.CAConfig.RootDir, caName))
+	// CA store keeps keys in PKCS#1 form, so ECDSA and Ed25519 CAs cannot be imported
+	key, ok := bundle.Key.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("CA key is %s, only RSA keys can be imported", keyTypeName(bundle.Key))
+	}
+	if err := bundle.verify(); err != nil {
+		return fmt.Errorf("failed to verify CA: %v", err)
+	}
+	if bundle.Cert.CheckSignatureFrom(bundle.Cert) != nil && len(bundle.Chain) == 0 {
+		fmt.Println("WARNING: CA certificate is not self-signed and issuer chain was not provided")
+	}
+
+	caStore := getCAStore(cfg, "")
+	if err := caStore.Add(caName, caName, true, x509.MarshalPKCS1PrivateKey(key), bundle.Cert.Raw); err != nil {
+		return err
+	}
+
+	if len(bundle.Chain) > 0 {
+		chainFile, err := os.Create(caChainFile(cfg, caName))
+		if err != nil {
+			return err
+		}
+		defer chainFile.Close()
+		for _, cert := range bundle.Chain {
+			if err := pem.Encode(chainFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+				return err
+			}
+		}
+		fmt.Println("Issuer chain saved to", chainFile.Name())
+	}
+	return nil
+}
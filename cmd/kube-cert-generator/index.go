@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"github.com/google/easypki/pkg/easypki"
+)
+
+// caIndexFile returns path of openssl compatible index of certificates issued by CA
+func caIndexFile(cfg *Config, caName string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "index.txt")
+}
+
+// issuedCertFile returns path of copy of certificate issued by CA
+func issuedCertFile(cfg *Config, caName string, serial *big.Int) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "issued", indexSerial(serial)+".pem")
+}
+
+// caSerialFile returns path of openssl compatible file containing next sequential serial of CA
+func caSerialFile(cfg *Config, caName string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "serial")
+}
+
+// caCRLFile returns path of certificate revocation list written after revocation
+func caCRLFile(cfg *Config, caName string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "crls", caName+".crl")
+}
+
+// crlValidity is period after which revocation list must be regenerated
+const crlValidity = 30 * 24 * time.Hour
+
+func indexSerial(serial *big.Int) string {
+	sn := fmt.Sprintf("%X", serial)
+	// openssl requires even length
+	if len(sn)%2 == 1 {
+		sn = "0" + sn
+	}
+	return sn
+}
+
+func indexSubject(cert *x509.Certificate) string {
+	var subject string
+	for _, part := range []struct {
+		key    string
+		values []string
+	}{
+		{"C", cert.Subject.Country},
+		{"O", cert.Subject.Organization},
+		{"OU", cert.Subject.OrganizationalUnit},
+		{"L", cert.Subject.Locality},
+		{"ST", cert.Subject.Province},
+	} {
+		for _, value := range part.values {
+			subject += "/" + part.key + "=" + value
+		}
+	}
+	return subject + "/CN=" + cert.Subject.CommonName
+}
+
+// recordIssued adds certificate signed by CA to CA index and keeps its copy so it can be found by serial and revoked later.
+// Index has the same format as one written by easypki for certificates stored in CA.
+func recordIssued(cfg *Config, caName, name string, cert *x509.Certificate) error {
+	f, err := os.OpenFile(caIndexFile(cfg, caName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "V\t%vZ\t\t%v\t%v.crt\t%v\n",
+		cert.NotAfter.UTC().Format("060102150405"),
+		indexSerial(cert.SerialNumber),
+		name,
+		indexSubject(cert))
+	if err != nil {
+		return err
+	}
+	if err := createDirIfNotExists(path.Dir(issuedCertFile(cfg, caName, cert.SerialNumber))); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(issuedCertFile(cfg, caName, cert.SerialNumber), encodeCerts(cert), 0644)
+}
+
+// nextSequentialSerial returns serial stored in CA serial file and stores the following one, like openssl ca does.
+// Serials already present in CA index are skipped. Serial file is locked so concurrent signers get distinct serials.
+func nextSequentialSerial(cfg *Config, caName string) (*big.Int, error) {
+	file := caSerialFile(cfg, caName)
+	lock, err := lockFile(file + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	serial := big.NewInt(1)
+	content, err := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if _, ok := serial.SetString(strings.TrimSpace(string(content)), 16); !ok {
+			return nil, fmt.Errorf("invalid serial number in %s", file)
+		}
+	}
+	for {
+		exists, err := isIndexed(cfg, caName, serial)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			break
+		}
+		serial.Add(serial, big.NewInt(1))
+	}
+	next := new(big.Int).Add(serial, big.NewInt(1))
+	if err := ioutil.WriteFile(file, []byte(indexSerial(next)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+// readIssuedCert returns certificate issued by CA with given serial
+func readIssuedCert(cfg *Config, caName string, serial *big.Int) (*x509.Certificate, error) {
+	return readCertFile(issuedCertFile(cfg, caName, serial))
+}
+
+// isIndexed reports whether certificate with given serial is present in CA index
+func isIndexed(cfg *Config, caName string, serial *big.Int) (bool, error) {
+	f, err := os.Open(caIndexFile(cfg, caName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sn := indexSerial(serial)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Split(scanner.Text(), "\t"); len(fields) > 3 && strings.EqualFold(fields[3], sn) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// caIndexEntry is line of CA index
+type caIndexEntry struct {
+	Status    string // V (valid), R (revoked) or E (expired)
+	Serial    *big.Int
+	Name      string // certificate name without extension
+	RevokedAt time.Time
+}
+
+// readCAIndex parses CA index, missing index has no entries
+func readCAIndex(cfg *Config, caName string) ([]caIndexEntry, error) {
+	file := caIndexFile(cfg, caName)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []caIndexEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%s:%d: invalid index line", file, line)
+		}
+		serial, ok := new(big.Int).SetString(fields[3], 16)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: invalid serial %q", file, line, fields[3])
+		}
+		entry := caIndexEntry{Status: fields[0], Serial: serial, Name: strings.TrimSuffix(fields[4], ".crt")}
+		if entry.Status == "R" {
+			// revocation date may be followed by reason
+			revokedAt := strings.TrimSuffix(strings.SplitN(fields[2], ",", 2)[0], "Z")
+			if entry.RevokedAt, err = time.Parse("060102150405", revokedAt); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid revocation date: %v", file, line, err)
+			}
+		}
+		ret = append(ret, entry)
+	}
+	return ret, scanner.Err()
+}
+
+// isRevoked reports whether certificate with given serial is revoked in CA index
+func isRevoked(cfg *Config, caName string, serial *big.Int) (bool, error) {
+	revoked, err := getCAStore(cfg, "").Revoked(caName)
+	if err != nil {
+		return false, err
+	}
+	for _, cert := range revoked {
+		if cert.SerialNumber.Cmp(serial) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readCertFile reads first certificate from PEM or DER file
+func readCertFile(file string) (*x509.Certificate, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	certs, _, err := parseCertsAndKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return certs[0], nil
+}
+
+// findIssuerCA returns name of CA from CA store which signed certificate or empty string if there is no such CA
+func findIssuerCA(cfg *Config, cert *x509.Certificate) (string, error) {
+	root := cfg.CAConfig.RootDir
+	if root == "" {
+		root = "."
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		ca, err := readCertFile(caCertFile(cfg, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if cert.CheckSignatureFrom(ca) == nil {
+			return entry.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// revokeCert marks certificate as revoked in CA index, records it in issuance log on behalf of operator
+// and regenerates CA revocation list
+func revokeCert(cfg *Config, caName, name string, cert *x509.Certificate, operator string) error {
+	pki := easypki.EasyPKI{Store: getCAStore(cfg, "")}
+	ca, err := pki.GetCA(caName)
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignatureFrom(ca.Cert); err != nil {
+		return fmt.Errorf("certificate %s is not issued by %s: %v", name, caName, err)
+	}
+	indexed, err := isIndexed(cfg, caName, cert.SerialNumber)
+	if err != nil {
+		return err
+	}
+	if !indexed {
+		// certificate was signed before issued certificates were recorded
+		if err := recordIssued(cfg, caName, name, cert); err != nil {
+			return err
+		}
+	}
+	if err := pki.Revoke(caName, cert); err != nil {
+		return err
+	}
+	fmt.Printf("Certificate %s (serial %s) revoked by %s\n", name, indexSerial(cert.SerialNumber), caName)
+	if err := appendIssuanceLog(cfg, caName, issuanceLogEntry{
+		Action:      issuanceRevoke,
+		Name:        name,
+		Serial:      indexSerial(cert.SerialNumber),
+		Subject:     cert.Subject.String(),
+		Operator:    operator,
+		Fingerprint: generator.CertFingerprint(cert),
+	}); err != nil {
+		return fmt.Errorf("failed to record revocation in %s issuance log: %v", caName, err)
+	}
+
+	crl, err := pki.CRL(caName, time.Now().Add(crlValidity))
+	if err != nil {
+		return err
+	}
+	crlFile := caCRLFile(cfg, caName)
+	return writeOutputFile(generator.DirFS(path.Dir(crlFile)), path.Dir(crlFile), path.Base(crlFile), 0644, true, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	lockTimeout       = 30 * time.Second
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+// lockFile waits until exclusive lock on file is taken by tryLockFile. It is used to serialize updates
+// of CA files shared by concurrently running commands, e.g. serve, agent and controller.
+func lockFile(name string) (*fileLock, error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		lock, err := tryLockFile(name)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to lock %s: timed out after %s", name, lockTimeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileLock is advisory lock released by kernel when process exits
+type fileLock struct {
+	file *os.File
+}
+
+// tryLockFile takes exclusive lock on file without waiting, it returns nil lock if file is locked by other process
+func tryLockFile(name string) (*fileLock, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", name, err)
+	}
+	return &fileLock{file: f}, nil
+}
+
+func (l *fileLock) unlock() error {
+	return l.file.Close()
+}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// fileLock is lock file which exists while lock is held
+type fileLock struct {
+	name string
+	file *os.File
+}
+
+// tryLockFile creates lock file, it returns nil lock if file already exists
+func tryLockFile(name string) (*fileLock, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{name: name, file: f}, nil
+}
+
+func (l *fileLock) unlock() error {
+	l.file.Close()
+	return os.Remove(l.name)
+}
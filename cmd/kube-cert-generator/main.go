@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/BurntSushi/toml"
 	"gopkg.in/urfave/cli.v2"
 )
 
@@ -18,12 +17,12 @@ var (
 	outputDirFlag = cli.StringFlag{
 		Name:    "output",
 		Aliases: []string{"o"},
-		Usage:   "path to output dir",
+		Usage:   "path to output dir or archive (.tar, .tar.gz, .tgz, .zip, with .age suffix to encrypt it)",
 		Value:   "cert",
 	}
 	inputDirFlag = cli.StringFlag{
 		Name:    "input",
-		Aliases: []string{"o"},
+		Aliases: []string{"i"},
 		Usage:   "path to input dir",
 		Value:   "cert",
 	}
@@ -36,6 +35,30 @@ func main() {
 			&generateCSRsCmd,
 			&initCACmd,
 			&signCommand,
+			&bundleCmd,
+			&decryptCmd,
+			&manifestCmd,
+			&verifyManifestCmd,
+			&auditCmd,
+			&ocspServeCmd,
+			&ocspSignerCmd,
+			&exportPKCS12Cmd,
+			&importCACmd,
+			&rotateCACmd,
+			&validateConfigCmd,
+			&addNodeCmd,
+			&removeNodeCmd,
+			&reconcileCmd,
+			&submitCmd,
+			&listPendingCmd,
+			&approveCmd,
+			&denyCmd,
+			&serveCmd,
+			&controllerCmd,
+			&exporterCmd,
+			&checkCmd,
+			&agentCmd,
+			&apiserverFlagsCmd,
 		},
 		Version: "1.0.5",
 	}
@@ -47,17 +70,20 @@ func main() {
 }
 
 func initConfig(ctx *cli.Context) error {
-	var cfg Config
-	if _, err := toml.DecodeFile(ctx.String(configFlag.Name), &cfg); err != nil {
+	cfg, unknownKeys, err := LoadConfig(ctx.String(configFlag.Name))
+	if err != nil {
 		return err
 	}
-	ctx.App.Metadata[configContextKey] = &cfg
+	if problems := ValidateConfig(cfg, unknownKeys); len(problems) > 0 {
+		return fmt.Errorf("invalid config %s: %v (run validate-config to see all problems)", ctx.String(configFlag.Name), problems[0])
+	}
+	ctx.App.Metadata[configContextKey] = cfg
 	return nil
 }
 
 func initOutputDir(ctx *cli.Context) error {
 	ctx.App.Metadata[outputDirContextKey] = ctx.String("output")
-	if outDir := ctx.App.Metadata[outputDirContextKey].(string); outDir != "" {
+	if outDir := ctx.App.Metadata[outputDirContextKey].(string); outDir != "" && !isArchiveOutput(outDir) {
 		if err := createDirIfNotExists(outDir); err != nil {
 			return err
 		}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+var (
+	signingKeyFlag = cli.StringFlag{
+		Name:  "signing-key",
+		Usage: "path to private key signing manifest, CA key is used if not set",
+	}
+	signingCertFlag = cli.StringFlag{
+		Name:  "signing-cert",
+		Usage: "path to certificate of signing key followed by its intermediate CAs, it must be CA or have code signing usage",
+	}
+	trustedCAFlag = cli.StringSliceFlag{
+		Name:  "ca",
+		Usage: "path to trusted CA certificate which issued manifest signer, may be repeated",
+	}
+	signerFingerprintFlag = cli.StringSliceFlag{
+		Name:  "signer-fingerprint",
+		Usage: "SHA-256 fingerprint of certificate allowed to sign manifest, may be repeated; if not set only CA or code signing certificates are accepted",
+	}
+)
+
+// manifestSigner is key which signs manifest together with its certificate chain
+type manifestSigner struct {
+	Key   crypto.Signer
+	Certs []*x509.Certificate
+}
+
+// loadManifestSigner loads key given by --signing-key and --signing-cert or key of CA from store
+func loadManifestSigner(ctx *cli.Context, cfg *Config, caName string) (*manifestSigner, error) {
+	keyFile := ctx.String(signingKeyFlag.Name)
+	if keyFile == "" {
+		ca, err := loadSigningCA(cfg, caName)
+		if err != nil {
+			return nil, err
+		}
+		certs := append([]*x509.Certificate(nil), ca.Chain.Intermediates...)
+		if ca.Chain.Root != nil {
+			certs = append(certs, ca.Chain.Root)
+		}
+		return &manifestSigner{Key: ca.Key, Certs: certs}, nil
+	}
+
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certs, key, err := parseCertsAndKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", keyFile, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key not found in %s", keyFile)
+	}
+	if certFile := ctx.String(signingCertFlag.Name); certFile != "" {
+		content, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		if certs, _, err = parseCertsAndKey(content); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", certFile, err)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("certificate of signing key is not set, use --%s", signingCertFlag.Name)
+	}
+	return &manifestSigner{Key: signer, Certs: certs}, nil
+}
+
+// buildManifest lists files of certificates described by config which exist in fs. If node is not nil
+// only files of this node are listed. extraFiles, e.g. CA certificates, are added with ca role.
+func buildManifest(cfg *Config, fs generator.FS, node *string, extraFiles []string) (*generator.Manifest, error) {
+	specs, err := cfg.CertSpecs()
+	if err != nil {
+		return nil, err
+	}
+	ret := &generator.Manifest{Created: time.Now().UTC()}
+	for _, name := range extraFiles {
+		if err := ret.Add(fs, name, "ca", ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range specs {
+		if node != nil && spec.Node != *node {
+			continue
+		}
+		for _, suffix := range certFileSuffixes {
+			exists, err := fs.Exists(spec.Name + suffix)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+			if err := ret.Add(fs, spec.Name+suffix, spec.Group, spec.Node); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ret, nil
+}
+
+// writeManifest signs manifest and writes it to fs together with signature
+func writeManifest(m *generator.Manifest, signer *manifestSigner, fs generator.FS, outputDir string) error {
+	content, signature, err := generator.SignManifest(m, signer.Key, signer.Certs)
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest: %v", err)
+	}
+	if err := writeOutputFile(fs, outputDir, generator.ManifestFile, 0644, true, content); err != nil {
+		return err
+	}
+	return writeOutputFile(fs, outputDir, generator.ManifestSignatureFile, 0644, true, signature)
+}
+
+var manifestCmd = cli.Command{
+	Name:  "manifest",
+	Usage: "Write signed manifest of certificate files in output dir",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+		&signingKeyFlag,
+		&signingCertFlag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if err := initConfig(ctx); err != nil {
+			return err
+		}
+		return initOutputDir(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		cfg, outputDir := ctx.App.Metadata[configContextKey].(*Config), ctx.App.Metadata[outputDirContextKey].(string)
+		signer, err := loadManifestSigner(ctx, cfg, ctx.String(caNameFlag.Name))
+		if err != nil {
+			return err
+		}
+		manifest, err := buildManifest(cfg, generator.DirFS(outputDir), nil, nil)
+		if err != nil {
+			return err
+		}
+		return writeManifest(manifest, signer, generator.DirFS(outputDir), outputDir)
+	},
+}
+
+// unlistedFiles returns files in dir which are not listed in manifest
+func unlistedFiles(dir string, manifest *generator.Manifest) ([]string, error) {
+	listed := map[string]bool{generator.ManifestFile: true, generator.ManifestSignatureFile: true}
+	for _, entry := range manifest.Files {
+		listed[entry.File] = true
+	}
+	var ret []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if name = filepath.ToSlash(name); !listed[name] {
+			ret = append(ret, name)
+		}
+		return nil
+	})
+	sort.Strings(ret)
+	return ret, err
+}
+
+var verifyManifestCmd = cli.Command{
+	Name:  "verify-manifest",
+	Usage: "Check that files in input dir match signed manifest",
+	Flags: []cli.Flag{
+		&inputDirFlag,
+		&trustedCAFlag,
+		&signerFingerprintFlag,
+	},
+	Action: func(ctx *cli.Context) error {
+		inputDir := ctx.String(inputDirFlag.Name)
+		if len(ctx.StringSlice(trustedCAFlag.Name)) == 0 {
+			return fmt.Errorf("trusted CA is not set, use --%s", trustedCAFlag.Name)
+		}
+		roots := x509.NewCertPool()
+		for _, file := range ctx.StringSlice(trustedCAFlag.Name) {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			certs, _, err := parseCertsAndKey(content)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", file, err)
+			}
+			for _, cert := range certs {
+				roots.AddCert(cert)
+			}
+		}
+
+		fs := generator.DirFS(inputDir)
+		content, err := fs.ReadFile(generator.ManifestFile)
+		if err != nil {
+			return err
+		}
+		signature, err := fs.ReadFile(generator.ManifestSignatureFile)
+		if err != nil {
+			return err
+		}
+		manifest, signer, err := generator.VerifyManifest(content, signature, roots, ctx.StringSlice(signerFingerprintFlag.Name))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Manifest created at %s signed by %s\n", manifest.Created.Format(time.RFC3339), signer.Subject)
+
+		problems := manifest.Check(fs)
+		for _, problem := range problems {
+			fmt.Println("MISMATCH:", problem)
+		}
+		unlisted, err := unlistedFiles(inputDir, manifest)
+		if err != nil {
+			return err
+		}
+		for _, name := range unlisted {
+			fmt.Println("WARNING: file is not listed in manifest:", name)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d of %d file(s) do not match manifest", len(problems), len(manifest.Files))
+		}
+		fmt.Printf("OK: %d file(s) match manifest\n", len(manifest.Files))
+		return nil
+	},
+}
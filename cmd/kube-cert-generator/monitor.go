@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/urfave/cli.v2"
+)
+
+// Kinds of monitored certificates
+const (
+	expiryKindCert = "cert"
+	expiryKindCA   = "ca"
+)
+
+// Nagios plugin exit codes
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStatusNames = map[int]string{
+	checkOK:       "OK",
+	checkWarning:  "WARNING",
+	checkCritical: "CRITICAL",
+	checkUnknown:  "UNKNOWN",
+}
+
+const metricsPrefix = "kube_cert_generator_"
+
+var (
+	metricsListenFlag = cli.StringFlag{
+		Name:  "listen",
+		Usage: "address to serve metrics on",
+		Value: ":9523",
+	}
+	textfileFlag = cli.StringFlag{
+		Name:  "textfile",
+		Usage: "write metrics to node_exporter textfile collector file once instead of serving them",
+	}
+	warnFlag = cli.StringFlag{
+		Name:  "warn",
+		Usage: "warn if certificate expires within this period, e.g. 30d or 720h",
+		Value: "30d",
+	}
+	critFlag = cli.StringFlag{
+		Name:  "crit",
+		Usage: "critical if certificate expires within this period",
+		Value: "7d",
+	}
+)
+
+// certExpiry describes validity of single certificate
+type certExpiry struct {
+	Name      string
+	Kind      string
+	File      string
+	Serial    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// expiryReport contains certificates found in output dir and CA store and files which could not be read
+type expiryReport struct {
+	Certs  []certExpiry
+	Errors []string
+}
+
+// collectCertExpiry reads certificates from outputDir and CA certificates from CA store
+func collectCertExpiry(cfg *Config, outputDir string) (*expiryReport, error) {
+	ret := &expiryReport{}
+	add := func(name, kind, file string) {
+		cert, err := readCertFile(file)
+		if err != nil {
+			ret.Errors = append(ret.Errors, fmt.Sprintf("%s: %v", file, err))
+			return
+		}
+		ret.Certs = append(ret.Certs, certExpiry{
+			Name:      name,
+			Kind:      kind,
+			File:      file,
+			Serial:    indexSerial(cert.SerialNumber),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+
+	certFiles, err := filepath.Glob(path.Join(outputDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(certFiles)
+	for _, certFile := range certFiles {
+		add(strings.TrimSuffix(filepath.Base(certFile), ".crt"), expiryKindCert, certFile)
+	}
+
+	root := cfg.CAConfig.RootDir
+	if root == "" {
+		root = "."
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(caCertFile(cfg, entry.Name())); entry.IsDir() && err == nil {
+			add(entry.Name(), expiryKindCA, caCertFile(cfg, entry.Name()))
+		}
+	}
+	return ret, nil
+}
+
+// parseExpiryPeriod parses duration which may also be given in days, e.g. 30d
+func parseExpiryPeriod(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid period %q", value)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+func formatExpiryPeriod(d time.Duration) string {
+	if d < 0 {
+		return "-" + formatExpiryPeriod(-d)
+	}
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.Truncate(time.Minute).String()
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeMetrics formats report in Prometheus text exposition format
+func writeMetrics(report *expiryReport, now time.Time) []byte {
+	var buf bytes.Buffer
+	metrics := []struct {
+		name, help string
+		value      func(cert certExpiry) float64
+	}{
+		{"cert_not_after_timestamp_seconds", "Time after which certificate is not valid.", func(cert certExpiry) float64 {
+			return float64(cert.NotAfter.Unix())
+		}},
+		{"cert_not_before_timestamp_seconds", "Time before which certificate is not valid.", func(cert certExpiry) float64 {
+			return float64(cert.NotBefore.Unix())
+		}},
+		{"cert_expiry_seconds", "Seconds until certificate expires, negative if it has expired.", func(cert certExpiry) float64 {
+			return cert.NotAfter.Sub(now).Seconds()
+		}},
+		{"cert_validity_seconds", "Total validity period of certificate.", func(cert certExpiry) float64 {
+			return cert.NotAfter.Sub(cert.NotBefore).Seconds()
+		}},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s%s %s\n# TYPE %s%s gauge\n", metricsPrefix, metric.name, metric.help, metricsPrefix, metric.name)
+		for _, cert := range report.Certs {
+			fmt.Fprintf(&buf, "%s%s{name=\"%s\",kind=\"%s\",serial=\"%s\"} %s\n", metricsPrefix, metric.name,
+				escapeLabelValue(cert.Name), cert.Kind, cert.Serial, strconv.FormatFloat(metric.value(cert), 'f', -1, 64))
+		}
+	}
+	fmt.Fprintf(&buf, "# HELP %sread_errors Certificate files which could not be read.\n# TYPE %sread_errors gauge\n%sread_errors %d\n",
+		metricsPrefix, metricsPrefix, metricsPrefix, len(report.Errors))
+	return buf.Bytes()
+}
+
+// writeTextfile atomically replaces node_exporter textfile collector file
+func writeTextfile(file string, content []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+var exporterCmd = cli.Command{
+	Name:  "exporter",
+	Usage: "Serve Prometheus metrics about expiration of certificates in output dir and CA store",
+	Flags: []cli.Flag{
+		&configFlag,
+		&outputDirFlag,
+		&metricsListenFlag,
+		&textfileFlag,
+	},
+	Before: initConfig,
+	Action: func(ctx *cli.Context) error {
+		cfg, outputDir := ctx.App.Metadata[configContextKey].(*Config), ctx.String(outputDirFlag.Name)
+		if file := ctx.String(textfileFlag.Name); file != "" {
+			report, err := collectCertExpiry(cfg, outputDir)
+			if err != nil {
+				return err
+			}
+			for _, problem := range report.Errors {
+				fmt.Println("WARNING:", problem)
+			}
+			return writeTextfile(file, writeMetrics(report, time.Now()))
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			// certificates are read on every scrape so renewed ones are picked up without restart
+			report, err := collectCertExpiry(cfg, outputDir)
+			if err != nil {
+				log.Printf("failed to read certificates: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, problem := range report.Errors {
+				log.Println(problem)
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.Write(writeMetrics(report, time.Now()))
+		})
+		fmt.Printf("Serve metrics on http://%s/metrics\n", ctx.String(metricsListenFlag.Name))
+		return http.ListenAndServe(ctx.String(metricsListenFlag.Name), mux)
+	},
+}
+
+// checkCertExpiry returns Nagios status and lines describing certificates which expire within warn or crit period
+func checkCertExpiry(report *expiryReport, warn, crit time.Duration, now time.Time) (int, []string) {
+	status := checkOK
+	var problems []string
+	for _, cert := range report.Certs {
+		left := cert.NotAfter.Sub(now)
+		certStatus := checkOK
+		switch {
+		case left < crit:
+			certStatus = checkCritical
+		case left < warn:
+			certStatus = checkWarning
+		}
+		if certStatus == checkOK {
+			continue
+		}
+		if certStatus > status {
+			status = certStatus
+		}
+		message := fmt.Sprintf("%s %s %s expires in %s (%s)", checkStatusNames[certStatus], cert.Kind, cert.Name, formatExpiryPeriod(left), cert.NotAfter.UTC().Format(time.RFC3339))
+		if left <= 0 {
+			message = fmt.Sprintf("%s %s %s expired %s ago (%s)", checkStatusNames[certStatus], cert.Kind, cert.Name, formatExpiryPeriod(-left), cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		problems = append(problems, message)
+	}
+	for _, problem := range report.Errors {
+		if status == checkOK {
+			status = checkUnknown
+		}
+		problems = append(problems, "UNKNOWN "+problem)
+	}
+	return status, problems
+}
+
+var checkCmd = cli.Command{
+	Name:  "check",
+	Usage: "Check expiration of certificates in output dir and CA store with Nagios plugin exit codes",
+	Flags: []cli.Flag{
+		&configFlag,
+		&outputDirFlag,
+		&warnFlag,
+		&critFlag,
+	},
+	Action: func(ctx *cli.Context) error {
+		// config is loaded here rather than in Before so config problems are reported as UNKNOWN without usage text
+		if err := initConfig(ctx); err != nil {
+			fmt.Printf("UNKNOWN - %v\n", err)
+			return cli.Exit("", checkUnknown)
+		}
+		warn, err := parseExpiryPeriod(ctx.String(warnFlag.Name))
+		if err != nil {
+			fmt.Printf("UNKNOWN - --%s: %v\n", warnFlag.Name, err)
+			return cli.Exit("", checkUnknown)
+		}
+		crit, err := parseExpiryPeriod(ctx.String(critFlag.Name))
+		if err != nil {
+			fmt.Printf("UNKNOWN - --%s: %v\n", critFlag.Name, err)
+			return cli.Exit("", checkUnknown)
+		}
+		report, err := collectCertExpiry(ctx.App.Metadata[configContextKey].(*Config), ctx.String(outputDirFlag.Name))
+		if err != nil {
+			fmt.Printf("UNKNOWN - %v\n", err)
+			return cli.Exit("", checkUnknown)
+		}
+
+		status, problems := checkCertExpiry(report, warn, crit, time.Now())
+		if status == checkOK {
+			fmt.Printf("OK - %d certificate(s) valid for more than %s\n", len(report.Certs), formatExpiryPeriod(warn))
+			return nil
+		}
+		fmt.Printf("%s - %d of %d certificate(s) need attention\n", checkStatusNames[status], len(problems), len(report.Certs)+len(report.Errors))
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		return cli.Exit("", status)
+	},
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/cert"
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// Node roles supported by add-node and remove-node
+const (
+	nodeRoleWorker = "worker"
+	nodeRoleEtcd   = "etcd"
+	nodeRoleMaster = "master"
+)
+
+var nodeRoles = []string{nodeRoleWorker, nodeRoleEtcd, nodeRoleMaster}
+
+var (
+	nodeRoleFlag = cli.StringFlag{
+		Name:  "role",
+		Usage: fmt.Sprintf("node role (%v)", nodeRoles),
+		Value: nodeRoleWorker,
+	}
+	nodeAliasFlag = cli.StringFlag{
+		Name:  "alias",
+		Usage: "node alias, not used for master",
+	}
+	nodeAddressFlag = cli.StringSliceFlag{
+		Name:  "address",
+		Usage: "node address (DNS name, IP, email or URL), may be repeated",
+	}
+	saveConfigFlag = cli.BoolFlag{
+		Name:  "save-config",
+		Usage: "write updated node list back to config file (comments are not preserved)",
+	}
+)
+
+// archiveDirName is directory inside output dir where files of removed nodes are moved
+const archiveDirName = "archive"
+
+// suffixes of files which can be written for certificate by gen-csr and sign
+var certFileSuffixes = []string{".key", ".csr", ".crt", "-chain.pem", "-fullchain.pem", ".pem", ".p12"}
+
+func nodeFromContext(ctx *cli.Context) (string, cert.Host, error) {
+	role, host := ctx.String(nodeRoleFlag.Name), cert.Host{
+		Alias:     ctx.String(nodeAliasFlag.Name),
+		Addresses: ctx.StringSlice(nodeAddressFlag.Name),
+	}
+	switch role {
+	case nodeRoleWorker, nodeRoleEtcd:
+		if host.Alias == "" {
+			return "", cert.Host{}, fmt.Errorf("--%s must be specified for %s node", nodeAliasFlag.Name, role)
+		}
+	case nodeRoleMaster:
+		if len(host.Addresses) == 0 {
+			return "", cert.Host{}, fmt.Errorf("--%s must be specified for master node", nodeAddressFlag.Name)
+		}
+	default:
+		return "", cert.Host{}, fmt.Errorf("unknown node role %q, must be one of %v", role, nodeRoles)
+	}
+	return role, host, nil
+}
+
+func nodeCmdBefore(ctx *cli.Context) error {
+	if _, _, err := nodeFromContext(ctx); err != nil {
+		return err
+	}
+	if err := initConfig(ctx); err != nil {
+		return err
+	}
+	return initOutputDir(ctx)
+}
+
+var addNodeCmd = cli.Command{
+	Name:  "add-node",
+	Usage: "Generate and sign certificates for single node without touching the rest of PKI",
+	Flags: []cli.Flag{
+		&nodeRoleFlag,
+		&nodeAliasFlag,
+		&nodeAddressFlag,
+		&saveConfigFlag,
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+		&outputsFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+	},
+	Before: nodeCmdBefore,
+	Action: func(ctx *cli.Context) error {
+		role, host, _ := nodeFromContext(ctx)
+		configFile := ""
+		if ctx.Bool(saveConfigFlag.Name) {
+			configFile = ctx.String(configFlag.Name)
+		}
+		return addNode(ctx.App.Metadata[configContextKey].(*Config), configFile, role, host, ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string), signOptions{
+			Outputs:        ctx.StringSlice(outputsFlag.Name),
+			PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+			PKCS12Password: passwordFromContext(ctx, true),
+		})
+	},
+}
+
+var removeNodeCmd = cli.Command{
+	Name:  "remove-node",
+	Usage: "Revoke certificates of single node and move its files to archive",
+	Flags: []cli.Flag{
+		&nodeRoleFlag,
+		&nodeAliasFlag,
+		&nodeAddressFlag,
+		&saveConfigFlag,
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+	},
+	Before: nodeCmdBefore,
+	Action: func(ctx *cli.Context) error {
+		role, host, _ := nodeFromContext(ctx)
+		configFile := ""
+		if ctx.Bool(saveConfigFlag.Name) {
+			configFile = ctx.String(configFlag.Name)
+		}
+		return removeNode(ctx.App.Metadata[configContextKey].(*Config), configFile, role, host, ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string), signOptions{
+			PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+			PKCS12Password: passwordFromContext(ctx, true),
+		})
+	},
+}
+
+// withNode returns copy of config with node added. Master node addresses are added to existing master node.
+func withNode(cfg *Config, role string, host cert.Host) *Config {
+	ret := *cfg
+	switch role {
+	case nodeRoleWorker:
+		ret.WorkerNodes = append(append([]cert.Host(nil), cfg.WorkerNodes...), host)
+	case nodeRoleEtcd:
+		ret.EtcdNodes = append(append([]cert.Host(nil), cfg.EtcdNodes...), host)
+	case nodeRoleMaster:
+		ret.MasterNode.Addresses = append(append([]string(nil), cfg.MasterNode.Addresses...), host.Addresses...)
+	}
+	return &ret
+}
+
+func withoutHost(hosts []cert.Host, alias string) ([]cert.Host, error) {
+	var ret []cert.Host
+	for _, host := range hosts {
+		if host.Alias != alias {
+			ret = append(ret, host)
+		}
+	}
+	if len(ret) == len(hosts) {
+		return nil, fmt.Errorf("node %q not found in config", alias)
+	}
+	return ret, nil
+}
+
+// withoutNode returns copy of config with node removed. For master node given addresses are removed.
+func withoutNode(cfg *Config, role string, host cert.Host) (*Config, error) {
+	ret := *cfg
+	var err error
+	switch role {
+	case nodeRoleWorker:
+		ret.WorkerNodes, err = withoutHost(cfg.WorkerNodes, host.Alias)
+	case nodeRoleEtcd:
+		ret.EtcdNodes, err = withoutHost(cfg.EtcdNodes, host.Alias)
+	case nodeRoleMaster:
+		remove := make(map[string]bool)
+		for _, address := range host.Addresses {
+			remove[address] = true
+		}
+		ret.MasterNode.Addresses = nil
+		for _, address := range cfg.MasterNode.Addresses {
+			if remove[address] {
+				delete(remove, address)
+				continue
+			}
+			ret.MasterNode.Addresses = append(ret.MasterNode.Addresses, address)
+		}
+		for address := range remove {
+			err = fmt.Errorf("master node address %q not found in config", address)
+		}
+	}
+	return &ret, err
+}
+
+// sameCertSpec reports whether specs describe the same certificate. Config paths are ignored
+// because removing a node shifts indices of all nodes after it.
+func sameCertSpec(a, b generator.CertSpec) bool {
+	a.ConfigPath, b.ConfigPath = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+// diffCertSpecs compares certificates generated for two configs.
+// It returns specs from newCfg which are not present in oldCfg or have different parameters
+// and specs from oldCfg which are not present in newCfg.
+func diffCertSpecs(oldCfg, newCfg *Config) (changed, removed []generator.CertSpec, err error) {
+	oldSpecs, err := oldCfg.CertSpecs()
+	if err != nil {
+		return nil, nil, err
+	}
+	newSpecs, err := newCfg.CertSpecs()
+	if err != nil {
+		return nil, nil, err
+	}
+	oldByName := make(map[string]generator.CertSpec)
+	for _, spec := range oldSpecs {
+		oldByName[spec.Name] = spec
+	}
+	for _, spec := range newSpecs {
+		if old, exists := oldByName[spec.Name]; !exists || !sameCertSpec(old, spec) {
+			changed = append(changed, spec)
+		}
+		delete(oldByName, spec.Name)
+	}
+	for _, spec := range oldSpecs {
+		if _, exists := oldByName[spec.Name]; exists {
+			removed = append(removed, spec)
+		}
+	}
+	return changed, removed, nil
+}
+
+// issueCerts generates keys and CSRs for specs and signs them replacing existing files
+func issueCerts(cfg *Config, specs []generator.CertSpec, caName, outputDir string, opts signOptions) error {
+	signCfg := *cfg
+	signCfg.OverwriteFiles = true
+	g := generator.New(&signCfg.Config, generator.DirFS(outputDir))
+	var files []string
+	for _, spec := range specs {
+		result, err := g.GenerateCSR(spec)
+		if err != nil {
+			return err
+		}
+		printCSRResult(outputDir, result)
+		files = append(files, path.Join(outputDir, result.CSRFile))
+	}
+	return signCSRs(&signCfg, files, caName, outputDir, opts)
+}
+
+// revokeAndArchive revokes certificate with given name and moves all its files to archiveDir.
+// Certificate is revoked by CA from CA store which issued it.
+func revokeAndArchive(cfg *Config, name, outputDir, archiveDir string) error {
+	certFile := path.Join(outputDir, name+".crt")
+	cert, err := readCertFile(certFile)
+	switch {
+	case os.IsNotExist(err):
+		fmt.Println("WARNING: certificate", certFile, "not found, nothing to revoke")
+	case err != nil:
+		return err
+	default:
+		issuer, err := findIssuerCA(cfg, cert)
+		if err != nil {
+			return err
+		}
+		if issuer == "" {
+			fmt.Println("WARNING: issuer of", certFile, "not found in CA store, certificate is not revoked")
+			break
+		}
+		if err := revokeCert(cfg, issuer, name, cert, ""); err != nil {
+			return err
+		}
+	}
+
+	for _, suffix := range certFileSuffixes {
+		fileName := path.Join(outputDir, name+suffix)
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			continue
+		}
+		if err := createDirIfNotExists(archiveDir); err != nil {
+			return err
+		}
+		if err := os.Rename(fileName, path.Join(archiveDir, name+suffix)); err != nil {
+			return err
+		}
+		fmt.Printf("File archived: %v\n", path.Join(archiveDir, name+suffix))
+	}
+	return nil
+}
+
+// addNode issues certificates for node added to config. If configFile is not empty updated config is saved there.
+func addNode(cfg *Config, configFile, role string, host cert.Host, caName, outputDir string, opts signOptions) error {
+	newCfg := withNode(cfg, role, host)
+	if problems := ValidateConfig(newCfg, nil); len(problems) > 0 {
+		return fmt.Errorf("cannot add node: %v", problems[0])
+	}
+	changed, _, err := diffCertSpecs(cfg, newCfg)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		fmt.Println("Node is already present in config, nothing to do")
+		return nil
+	}
+
+	fmt.Printf("Generate certificates for %s node\n", role)
+	if err := issueCerts(newCfg, changed, caName, outputDir, opts); err != nil {
+		return err
+	}
+	if configFile != "" {
+		if err := SaveConfig(newCfg, configFile); err != nil {
+			return err
+		}
+		fmt.Println("Config updated:", configFile)
+	}
+	return nil
+}
+
+// removeNode revokes and archives certificates of node removed from config.
+// Certificates which are shared with other nodes (e.g. apiserver one for master) are reissued.
+func removeNode(cfg *Config, configFile, role string, host cert.Host, caName, outputDir string, opts signOptions) error {
+	newCfg, err := withoutNode(cfg, role, host)
+	if err != nil {
+		return err
+	}
+	changed, removed, err := diffCertSpecs(cfg, newCfg)
+	if err != nil {
+		return err
+	}
+
+	archiveName := role
+	if host.Alias != "" && role != nodeRoleMaster {
+		archiveName += "-" + host.Alias
+	}
+	archiveDir := path.Join(outputDir, archiveDirName, archiveName+"-"+time.Now().UTC().Format("20060102150405"))
+	for _, spec := range append(removed, changed...) {
+		if err := revokeAndArchive(cfg, spec.Name, outputDir, archiveDir); err != nil {
+			return err
+		}
+	}
+	if len(changed) > 0 {
+		fmt.Println("Reissue certificates which contained removed node")
+		if err := issueCerts(newCfg, changed, caName, outputDir, opts); err != nil {
+			return err
+		}
+	}
+	if configFile != "" {
+		if err := SaveConfig(newCfg, configFile); err != nil {
+			return err
+		}
+		fmt.Println("Config updated:", configFile)
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"golang.org/x/crypto/ocsp"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// oidOCSPNoCheck marks delegated responder certificate which clients must not check for revocation, RFC 6960 4.2.2.2.1
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+const maxOCSPRequestSize = 64 * 1024
+
+var (
+	ocspListenFlag = cli.StringFlag{
+		Name:  "listen",
+		Usage: "address to listen on, empty to only write stapling responses",
+		Value: "127.0.0.1:8889",
+	}
+	responderKeyFlag = cli.StringFlag{
+		Name:  "responder-key",
+		Usage: "path to private key of delegated OCSP responder, CA key is used if not set",
+	}
+	responderCertFlag = cli.StringFlag{
+		Name:  "responder-cert",
+		Usage: "path to delegated OCSP responder certificate issued by CA (see ocsp-signer)",
+	}
+	responseValidityFlag = cli.DurationFlag{
+		Name:  "response-validity",
+		Usage: "period after which clients must fetch new response",
+		Value: 24 * time.Hour,
+	}
+	stapleDirFlag = cli.StringFlag{
+		Name:  "staple-dir",
+		Usage: "dir to write pre-signed responses for stapling to, they are refreshed at half of response validity",
+	}
+)
+
+// ocspResponder answers OCSP requests for certificates issued by CA using revocation state from CA index
+type ocspResponder struct {
+	cfg        *Config
+	caName     string
+	ca         *x509.Certificate
+	signer     crypto.Signer
+	signerCert *x509.Certificate // delegated responder certificate, nil if responses are signed by CA
+	validity   time.Duration
+	prefixes   []string // paths of configured OCSP server URLs, GET requests are base64 encoded after them
+}
+
+// samePublicKey reports whether both keys are equal
+func samePublicKey(a, b crypto.PublicKey) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	return err == nil && bytes.Equal(aDER, bDER)
+}
+
+// ocspPathPrefixes returns escaped paths of OCSP server URLs configured for CA
+func ocspPathPrefixes(cfg *Config, caName string) ([]string, error) {
+	var ret []string
+	for _, server := range cfg.CAConfig.Extensions.OCSPServers {
+		u, err := url.Parse(strings.Replace(server, generator.CAPlaceholder, caName, -1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OCSP server URL %s: %v", server, err)
+		}
+		if prefix := strings.TrimSuffix(u.EscapedPath(), "/"); prefix != "" {
+			ret = append(ret, prefix)
+		}
+	}
+	return ret, nil
+}
+
+func newOCSPResponder(ctx *cli.Context, cfg *Config, caName string) (*ocspResponder, error) {
+	ca, err := loadSigningCA(cfg, caName)
+	if err != nil {
+		return nil, err
+	}
+	ret := &ocspResponder{cfg: cfg, caName: caName, ca: ca.Cert, signer: ca.Key, validity: ctx.Duration(responseValidityFlag.Name)}
+	if ret.validity <= 0 {
+		return nil, fmt.Errorf("--%s must be positive", responseValidityFlag.Name)
+	}
+	if ret.prefixes, err = ocspPathPrefixes(cfg, caName); err != nil {
+		return nil, err
+	}
+	keyFile := ctx.String(responderKeyFlag.Name)
+	if keyFile == "" {
+		return ret, nil
+	}
+
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certs, key, err := parseCertsAndKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", keyFile, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key not found in %s", keyFile)
+	}
+	if certFile := ctx.String(responderCertFlag.Name); certFile != "" {
+		cert, err := readCertFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		certs = []*x509.Certificate{cert}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("responder certificate is not set, use --%s", responderCertFlag.Name)
+	}
+	cert := certs[0]
+	if err := cert.CheckSignatureFrom(ca.Cert); err != nil {
+		return nil, fmt.Errorf("responder certificate %s is not issued by %s: %v", cert.Subject, caName, err)
+	}
+	allowed := false
+	for _, usage := range cert.ExtKeyUsage {
+		allowed = allowed || usage == x509.ExtKeyUsageOCSPSigning
+	}
+	if !allowed {
+		return nil, fmt.Errorf("responder certificate %s is not allowed to sign OCSP responses", cert.Subject)
+	}
+	if !samePublicKey(cert.PublicKey, signer.Public()) {
+		return nil, fmt.Errorf("responder key %s does not match certificate %s", keyFile, cert.Subject)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("responder certificate %s expired at %s", cert.Subject, cert.NotAfter.Format(time.RFC3339))
+	}
+	ret.signer, ret.signerCert = signer, cert
+	return ret, nil
+}
+
+// issuedByCA reports whether request asks about certificate issued by responder CA
+func (r *ocspResponder) issuedByCA(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(r.ca.RawSubjectPublicKeyInfo, &info); err != nil {
+		return false
+	}
+	nameHash := req.HashAlgorithm.New()
+	nameHash.Write(r.ca.RawSubject)
+	keyHash := req.HashAlgorithm.New()
+	keyHash.Write(info.PublicKey.RightAlign())
+	return bytes.Equal(nameHash.Sum(nil), req.IssuerNameHash) && bytes.Equal(keyHash.Sum(nil), req.IssuerKeyHash)
+}
+
+func ocspStatusString(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// response returns signed response for certificate with given serial. Certificates missing in CA index are unknown.
+func (r *ocspResponder) response(serial *big.Int) ([]byte, int, error) {
+	entries, err := readCAIndex(r.cfg, r.caName)
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now().UTC().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: serial,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(r.validity),
+	}
+	for _, entry := range entries {
+		if entry.Serial.Cmp(serial) != 0 {
+			continue
+		}
+		if entry.Status == "R" {
+			template.Status, template.RevokedAt = ocsp.Revoked, entry.RevokedAt
+		} else {
+			// expired certificates are rejected by clients anyway
+			template.Status = ocsp.Good
+		}
+	}
+	responderCert := r.ca
+	if r.signerCert != nil {
+		// delegated responder certificate is included so clients can verify it was issued by CA
+		responderCert, template.Certificate = r.signerCert, r.signerCert
+	}
+	resp, err := ocsp.CreateResponse(r.ca, responderCert, template, r.signer)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp, template.Status, nil
+}
+
+// requestPath returns escaped GET request path without configured OCSP server path prefix and leading slash.
+// Base64 may contain slashes so only known prefixes are stripped.
+func (r *ocspResponder) requestPath(req *http.Request) string {
+	escaped := req.URL.EscapedPath()
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(escaped, prefix+"/") {
+			return strings.TrimPrefix(escaped, prefix+"/")
+		}
+	}
+	return strings.TrimPrefix(escaped, "/")
+}
+
+// ServeHTTP handles OCSP requests sent with POST or base64 encoded in GET path, RFC 6960 appendix A
+func (r *ocspResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		var encoded string
+		if encoded, err = url.PathUnescape(r.requestPath(req)); err == nil {
+			body, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	case http.MethodPost:
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxOCSPRequestSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	var ocspReq *ocsp.Request
+	if err == nil {
+		ocspReq, err = ocsp.ParseRequest(body)
+	}
+	if err != nil {
+		log.Printf("%s: malformed request: %v", req.RemoteAddr, err)
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	if !r.issuedByCA(ocspReq) {
+		log.Printf("%s: serial %s: issuer is not %s", req.RemoteAddr, indexSerial(ocspReq.SerialNumber), r.caName)
+		w.Write(ocsp.UnauthorizedErrorResponse)
+		return
+	}
+	resp, status, err := r.response(ocspReq.SerialNumber)
+	if err != nil {
+		log.Printf("%s: serial %s: %v", req.RemoteAddr, indexSerial(ocspReq.SerialNumber), err)
+		w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+	if req.Method == http.MethodGet {
+		// GET responses may be cached by HTTP proxies
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", int(r.validity.Seconds())))
+	}
+	log.Printf("%s: serial %s: %s", req.RemoteAddr, indexSerial(ocspReq.SerialNumber), ocspStatusString(status))
+	w.Write(resp)
+}
+
+// writeStaples writes pre-signed response for the latest certificate with every name in CA index to dir
+func (r *ocspResponder) writeStaples(dir string) error {
+	entries, err := readCAIndex(r.cfg, r.caName)
+	if err != nil {
+		return err
+	}
+	var names []string
+	latest := make(map[string]caIndexEntry)
+	for _, entry := range entries {
+		// CA certificate is recorded in its own index
+		if entry.Serial.Cmp(r.ca.SerialNumber) == 0 {
+			continue
+		}
+		if _, ok := latest[entry.Name]; !ok {
+			names = append(names, entry.Name)
+		}
+		latest[entry.Name] = entry
+	}
+	if err := createDirIfNotExists(dir); err != nil {
+		return err
+	}
+	for _, name := range names {
+		resp, _, err := r.response(latest[name].Serial)
+		if err != nil {
+			return fmt.Errorf("failed to sign response for %s: %v", name, err)
+		}
+		// names of certificates issued by API and controller contain prefix separated by colon
+		file := strings.Replace(name, ":", "_", -1) + ".ocsp"
+		if err := writeOutputFile(generator.DirFS(dir), dir, file, 0644, true, resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ocspServeCmd = cli.Command{
+	Name:  "ocsp-serve",
+	Usage: "Answer OCSP requests for certificates issued by certificate authority",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&ocspListenFlag,
+		&responderKeyFlag,
+		&responderCertFlag,
+		&responseValidityFlag,
+		&stapleDirFlag,
+	},
+	Before: initConfig,
+	Action: func(ctx *cli.Context) error {
+		cfg := ctx.App.Metadata[configContextKey].(*Config)
+		responder, err := newOCSPResponder(ctx, cfg, ctx.String(caNameFlag.Name))
+		if err != nil {
+			return err
+		}
+		address, stapleDir := ctx.String(ocspListenFlag.Name), ctx.String(stapleDirFlag.Name)
+		if address == "" && stapleDir == "" {
+			return fmt.Errorf("--%s or --%s must be set", ocspListenFlag.Name, stapleDirFlag.Name)
+		}
+		if stapleDir != "" {
+			if err := responder.writeStaples(stapleDir); err != nil {
+				return err
+			}
+		}
+		if address == "" {
+			return nil
+		}
+		if stapleDir != "" {
+			go func() {
+				for range time.Tick(responder.validity / 2) {
+					if err := responder.writeStaples(stapleDir); err != nil {
+						log.Printf("failed to refresh stapling responses: %v", err)
+					}
+				}
+			}()
+		}
+
+		server := http.Server{
+			Addr:         address,
+			Handler:      responder,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		fmt.Printf("Serve OCSP responses of %s on http://%s/\n", responder.caName, address)
+		return server.ListenAndServe()
+	},
+}
+
+// issueOCSPSigner creates key and delegated OCSP responder certificate issued by CA
+func issueOCSPSigner(cfg *Config, caName, outputDir string) error {
+	ca, err := loadSigningCA(cfg, caName)
+	if err != nil {
+		return err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, cfg.KeySize)
+	if err != nil {
+		return err
+	}
+	subject := cfg.CommonFields
+	subject.CommonName = caName + " OCSP responder"
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject.ToPKIXName()}, key)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	issue := generator.NewIssue(csr, generator.UsageOCSPSigning, cfg.ValidityPeriod.Duration)
+	issue.Extensions = []pkix.Extension{{Id: oidOCSPNoCheck, Value: asn1.NullBytes}}
+	name := caName + "-ocsp-signer"
+	cert, err := newGenerator(cfg, nil, "").IssueCert(ca.generatorCA(caName), name, csr, issue)
+	if err != nil {
+		return err
+	}
+
+	fs := generator.DirFS(outputDir)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := fs.WriteFile(name+".key", keyPEM, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("File created: %v\n", path.Join(outputDir, name+".key"))
+	return writeOutputFile(fs, outputDir, name+".crt", 0644, true, encodeCerts(cert))
+}
+
+var ocspSignerCmd = cli.Command{
+	Name:  "ocsp-signer",
+	Usage: "Issue delegated OCSP responder certificate for ocsp-serve",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if err := initConfig(ctx); err != nil {
+			return err
+		}
+		return initOutputDir(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		return issueOCSPSigner(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string))
+	},
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestResponder creates responder for self-signed CA and returns OCSP request for certificate issued by it
+func newTestResponder(t *testing.T, cfg *Config) (*ocspResponder, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "admin"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+	}, ca, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocspReq, err := ocsp.CreateRequest(leaf, ca, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefixes, err := ocspPathPrefixes(cfg, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CA index is missing so every certificate is unknown
+	cfg.CAConfig.RootDir = t.TempDir()
+	return &ocspResponder{cfg: cfg, caName: "root", ca: ca, signer: key, validity: time.Hour, prefixes: prefixes}, ocspReq
+}
+
+func getOCSPResponse(t *testing.T, responder *ocspResponder, uri string) *ocsp.Response {
+	server := httptest.NewServer(responder)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", uri, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := ocsp.ParseResponse(body, responder.ca)
+	if err != nil {
+		t.Fatalf("GET %s: %v", uri, err)
+	}
+	return ret
+}
+
+func TestOCSPServeGETUnderConfiguredPrefix(t *testing.T) {
+	cfg := &Config{}
+	cfg.CAConfig.Extensions.OCSPServers = []string{"http://pki.example.com/ocsp/{ca}"}
+	responder, ocspReq := newTestResponder(t, cfg)
+	if len(responder.prefixes) != 1 || responder.prefixes[0] != "/ocsp/root" {
+		t.Fatalf("prefixes %v, expected /ocsp/root", responder.prefixes)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(ocspReq)
+	for _, uri := range []string{
+		"/ocsp/root/" + encoded,
+		"/ocsp/root/" + strings.NewReplacer("+", "%2B", "/", "%2F", "=", "%3D").Replace(encoded), // clients may escape base64
+		"/" + encoded, // prefix stripped by reverse proxy
+	} {
+		resp := getOCSPResponse(t, responder, uri)
+		if resp.Status != ocsp.Unknown || resp.SerialNumber.Cmp(big.NewInt(2)) != 0 {
+			t.Errorf("GET %s: status %d for serial %s, expected unknown serial 2", uri, resp.Status, resp.SerialNumber)
+		}
+	}
+}
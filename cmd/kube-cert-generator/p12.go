@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"github.com/google/easypki/pkg/easypki"
+	"golang.org/x/term"
+	"gopkg.in/urfave/cli.v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	passwordFlag = cli.StringFlag{
+		Name:    "password",
+		Usage:   "PKCS#12 bundle password",
+		EnvVars: []string{"KUBE_CERT_GENERATOR_PASSWORD"},
+	}
+	passwordFileFlag = cli.StringFlag{
+		Name:  "password-file",
+		Usage: "path to file containing PKCS#12 bundle password",
+	}
+	legacyPKCS12Flag = cli.BoolFlag{
+		Name:  "legacy-p12",
+		Usage: "encrypt PKCS#12 bundles with legacy algorithms (3DES) for old Java and Windows versions",
+	}
+)
+
+// passwordSource returns password when it is needed for the first time
+type passwordSource func() (string, error)
+
+// passwordFromContext reads password from command line flag, environment variable or file.
+// If none of them is set user is asked to enter password.
+func passwordFromContext(ctx *cli.Context, confirm bool) passwordSource {
+	var password *string
+	return func() (string, error) {
+		if password != nil {
+			return *password, nil
+		}
+		var ret string
+		switch {
+		case ctx.IsSet(passwordFlag.Name):
+			ret = ctx.String(passwordFlag.Name)
+		case ctx.String(passwordFileFlag.Name) != "":
+			content, err := ioutil.ReadFile(ctx.String(passwordFileFlag.Name))
+			if err != nil {
+				return "", err
+			}
+			ret = strings.TrimRight(string(content), "\r\n")
+		default:
+			var err error
+			if ret, err = promptPassword(confirm); err != nil {
+				return "", err
+			}
+		}
+		password = &ret
+		return ret, nil
+	}
+}
+
+func promptPassword(confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("password is not set, use --%s, --%s or %s", passwordFlag.Name, passwordFileFlag.Name, passwordFlag.EnvVars[0])
+	}
+	fmt.Fprint(os.Stderr, "Enter PKCS#12 password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm PKCS#12 password: ")
+		confirmation, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(confirmation) != string(password) {
+			return "", errors.New("passwords do not match")
+		}
+	}
+	return string(password), nil
+}
+
+func pkcs12Encoder(legacy bool) *pkcs12.Encoder {
+	if legacy {
+		return pkcs12.LegacyDES
+	}
+	return pkcs12.Modern
+}
+
+// encodePKCS12 bundles private key from keyFile in keyFS, certificate and CA chain to PKCS#12
+func encodePKCS12(encoder *pkcs12.Encoder, keyFS generator.FS, keyFile string, cert *x509.Certificate, chain *caChain, password string) ([]byte, error) {
+	content, err := keyFS.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	_, key, err := parseCertsAndKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", keyFile, err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("private key not found in %s", keyFile)
+	}
+	caCerts := chain.Issuers()
+	if chain.Root != nil {
+		caCerts = append(caCerts, chain.Root)
+	}
+	return encoder.WithRand(rand.Reader).Encode(key, cert, caCerts, password)
+}
+
+var exportPKCS12Cmd = cli.Command{
+	Name:      "export-p12",
+	Usage:     "Bundle signed certificates with private keys and CA chain to PKCS#12 files",
+	ArgsUsage: "<cert files>",
+	Flags: append([]cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&inputDirFlag,
+		&outputDirFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+	}, outputSinkFlags...),
+	Before: func(ctx *cli.Context) error {
+		if err := initConfig(ctx); err != nil {
+			return err
+		}
+		return initOutputDir(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		return withOutputSink(ctx, func(sink generator.Sink, target string) error {
+			return exportPKCS12(ctx.App.Metadata[configContextKey].(*Config), ctx.Args().Slice(), ctx.String(caNameFlag.Name),
+				ctx.String(inputDirFlag.Name), sink, target, pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)), passwordFromContext(ctx, true))
+		})
+	},
+}
+
+func exportPKCS12(cfg *Config, files []string, caName, keyDir string, out generator.FS, outputDir string, encoder *pkcs12.Encoder, password passwordSource) error {
+	pki := easypki.EasyPKI{Store: getCAStore(cfg, "")}
+	caSigner, err := pki.GetCA(caName)
+	if err != nil {
+		return err
+	}
+	chain, err := loadCAChain(cfg, caName, caSigner)
+	if err != nil {
+		return err
+	}
+	opts := certOutputOptions{
+		FS:             out,
+		Dir:            outputDir,
+		KeyFS:          generator.DirFS(keyDir),
+		Overwrite:      cfg.OverwriteFiles,
+		Chain:          chain,
+		PKCS12Encoder:  encoder,
+		PKCS12Password: password,
+	}
+	for _, file := range files {
+		fmt.Println("Export", file)
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		certs, _, err := parseCertsAndKey(content)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		if len(certs) == 0 {
+			return fmt.Errorf("no certificates found in %s", file)
+		}
+		name := strings.TrimSuffix(path.Base(file), path.Ext(file))
+		if err := writePKCS12(name, name+".key", certs[0], opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePKCS12 writes <name>.p12 to opts.FS
+func writePKCS12(name, keyFile string, cert *x509.Certificate, opts certOutputOptions) error {
+	pass, err := opts.PKCS12Password()
+	if err != nil {
+		return err
+	}
+	pfx, err := encodePKCS12(opts.PKCS12Encoder, opts.KeyFS, keyFile, cert, opts.Chain, pass)
+	if err != nil {
+		return fmt.Errorf("failed to create %s.p12: %v", name, err)
+	}
+	return writeOutputFile(opts.FS, opts.Dir, name+".p12", 0600, opts.Overwrite, pfx)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// Policy modes define what sign does with CSR which violates policy
+const (
+	policyModeReject = "reject" // refuse to sign CSR
+	policyModeTrim   = "trim"   // remove disallowed organizations and SANs, refuse if it is not enough
+)
+
+// Key algorithms which can be allowed by policy
+const (
+	keyAlgorithmRSA     = "rsa"
+	keyAlgorithmECDSA   = "ecdsa"
+	keyAlgorithmEd25519 = "ed25519"
+)
+
+var knownKeyAlgorithms = []string{keyAlgorithmRSA, keyAlgorithmECDSA, keyAlgorithmEd25519}
+
+var profileFlag = cli.StringFlag{
+	Name:  "profile",
+	Usage: "signing policy profile applied to all CSRs instead of one chosen by config",
+}
+
+// SigningProfile restricts values which may be present in signed certificate.
+// Patterns are regular expressions matched against whole value. Empty list allows no values.
+type SigningProfile struct {
+	CommonNames   []string `toml:"common_names" yaml:"common_names" json:"common_names"`
+	Organizations []string `toml:"organizations" yaml:"organizations" json:"organizations"`
+	SANs          []string `toml:"sans" yaml:"sans" json:"sans"`                // DNS names, emails and URIs
+	IPRanges      []string `toml:"ip_ranges" yaml:"ip_ranges" json:"ip_ranges"` // CIDRs of allowed IP SANs
+	MaxValidity   Duration `toml:"max_validity" yaml:"max_validity" json:"max_validity"`
+	// "server auth" and "client auth" as in cfssl profiles, when set they replace usage requested by CSR or config
+	Usages []string `toml:"usages" yaml:"usages" json:"usages"`
+
+	// extensions added to every certificate signed with profile, they replace ones from config with the same OID
+	generator.ExtraExtensions `yaml:",inline"`
+}
+
+// SigningPolicy is checked by sign for every CSR
+type SigningPolicy struct {
+	Mode            string   `toml:"mode" yaml:"mode" json:"mode"`                               // reject (default) or trim
+	KeyAlgorithms   []string `toml:"key_algorithms" yaml:"key_algorithms" json:"key_algorithms"` // empty allows all
+	MinRSAKeySize   int      `toml:"min_rsa_key_size" yaml:"min_rsa_key_size" json:"min_rsa_key_size"`
+	MinECDSAKeySize int      `toml:"min_ecdsa_key_size" yaml:"min_ecdsa_key_size" json:"min_ecdsa_key_size"`
+	MaxValidity     Duration `toml:"max_validity" yaml:"max_validity" json:"max_validity"`
+
+	DefaultProfile string                    `toml:"default_profile" yaml:"default_profile" json:"default_profile"`
+	CertProfiles   map[string]string         `toml:"cert_profiles" yaml:"cert_profiles" json:"cert_profiles"` // certificate name to profile
+	Profiles       map[string]SigningProfile `toml:"profiles" yaml:"profiles" json:"profiles"`
+}
+
+// profileFor returns name of profile used for certificate with given name
+func (p *SigningPolicy) profileFor(name string) string {
+	if profile, ok := p.CertProfiles[name]; ok {
+		return profile
+	}
+	return p.DefaultProfile
+}
+
+// policyDecision contains values which are put to signed certificate
+type policyDecision struct {
+	generator.Issue
+	ProfileUsage bool     // usage is set by profile and must not be replaced
+	Notes        []string // changes made by policy
+}
+
+func newPolicyDecision(csr *x509.CertificateRequest, validity time.Duration) *policyDecision {
+	return &policyDecision{Issue: *generator.NewIssue(csr, generator.UsageServerClient, validity)}
+}
+
+func matchPatterns(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, err := regexp.MatchString("^(?:"+pattern+")$", value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func inIPRanges(ranges []string, ip net.IP) bool {
+	for _, ipRange := range ranges {
+		if _, network, err := net.ParseCIDR(ipRange); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAlgorithm returns algorithm name and key size of public key
+func keyAlgorithm(key interface{}) (string, int) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return keyAlgorithmRSA, key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return keyAlgorithmECDSA, key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return keyAlgorithmEd25519, 256
+	default:
+		return fmt.Sprintf("%T", key), 0
+	}
+}
+
+func (p *SigningPolicy) checkKey(key interface{}) error {
+	algorithm, size := keyAlgorithm(key)
+	if len(p.KeyAlgorithms) > 0 {
+		allowed := false
+		for _, known := range p.KeyAlgorithms {
+			allowed = allowed || known == algorithm
+		}
+		if !allowed {
+			return fmt.Errorf("key algorithm %s is not allowed, must be one of %v", algorithm, p.KeyAlgorithms)
+		}
+	}
+	switch {
+	case algorithm == keyAlgorithmRSA && size < p.MinRSAKeySize:
+		return fmt.Errorf("RSA key size %d is less than %d", size, p.MinRSAKeySize)
+	case algorithm == keyAlgorithmECDSA && size < p.MinECDSAKeySize:
+		return fmt.Errorf("ECDSA key size %d is less than %d", size, p.MinECDSAKeySize)
+	}
+	return nil
+}
+
+// apply checks CSR against policy profile. In trim mode disallowed organizations and SANs are removed.
+// Validity is always shortened to maximum allowed one.
+func (p *SigningPolicy) apply(profileName string, csr *x509.CertificateRequest, validity time.Duration) (*policyDecision, error) {
+	if profileName == "" {
+		return nil, fmt.Errorf("no signing profile, set policy default_profile or cert_profiles or use --%s", profileFlag.Name)
+	}
+	profile, ok := p.Profiles[profileName]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing profile %q", profileName)
+	}
+	trim := p.Mode == policyModeTrim
+	ret := newPolicyDecision(csr, validity)
+	ret.Profile = profileName
+	extensions, err := profile.Extensions()
+	if err != nil {
+		return nil, fmt.Errorf("signing profile %s: %v", profileName, err)
+	}
+	ret.Extensions = extensions
+	if len(profile.Usages) > 0 {
+		if ret.Usage, err = csrUsage(profile.Usages); err != nil {
+			return nil, fmt.Errorf("signing profile %s: %v", profileName, err)
+		}
+		ret.ProfileUsage = true
+	}
+	var violations []string
+	// disallowed reports violation or notes removed value in trim mode
+	disallowed := func(format string, args ...interface{}) {
+		message := fmt.Sprintf(format, args...)
+		if trim {
+			ret.Notes = append(ret.Notes, "removed "+message)
+		} else {
+			violations = append(violations, message+" is not allowed")
+		}
+	}
+
+	if err := p.checkKey(csr.PublicKey); err != nil {
+		violations = append(violations, err.Error())
+	}
+	if !matchPatterns(profile.CommonNames, csr.Subject.CommonName) {
+		violations = append(violations, fmt.Sprintf("CN=%s is not allowed", csr.Subject.CommonName))
+	}
+
+	ret.Subject.Organization = nil
+	for _, o := range csr.Subject.Organization {
+		if matchPatterns(profile.Organizations, o) {
+			ret.Subject.Organization = append(ret.Subject.Organization, o)
+		} else {
+			disallowed("O=%s", o)
+		}
+	}
+
+	ret.DNSNames, ret.EmailAddresses, ret.IPAddresses, ret.URIs = nil, nil, nil, nil
+	for _, dnsName := range csr.DNSNames {
+		if matchPatterns(profile.SANs, dnsName) {
+			ret.DNSNames = append(ret.DNSNames, dnsName)
+		} else {
+			disallowed("DNS SAN %s", dnsName)
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		if matchPatterns(profile.SANs, email) {
+			ret.EmailAddresses = append(ret.EmailAddresses, email)
+		} else {
+			disallowed("email SAN %s", email)
+		}
+	}
+	for _, uri := range csr.URIs {
+		if matchPatterns(profile.SANs, uri.String()) {
+			ret.URIs = append(ret.URIs, uri)
+		} else {
+			disallowed("URI SAN %s", uri)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if inIPRanges(profile.IPRanges, ip) {
+			ret.IPAddresses = append(ret.IPAddresses, ip)
+		} else {
+			disallowed("IP SAN %s", ip)
+		}
+	}
+
+	for _, maxValidity := range []time.Duration{profile.MaxValidity.Duration, p.MaxValidity.Duration} {
+		if maxValidity > 0 && ret.Validity > maxValidity {
+			ret.Notes = append(ret.Notes, fmt.Sprintf("validity period shortened from %v to %v", ret.Validity, maxValidity))
+			ret.Validity = maxValidity
+		}
+	}
+
+	if len(violations) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(violations, "; "))
+	}
+	return ret, nil
+}
+
+// applyPolicy checks CSR against signing policy if config has one and reports changes made by policy
+func (cfg *Config) applyPolicy(profile string, csr *x509.CertificateRequest, validity time.Duration) (*policyDecision, error) {
+	if cfg.Policy == nil {
+		return newPolicyDecision(csr, validity), nil
+	}
+	decision, err := cfg.Policy.apply(profile, csr, validity)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range decision.Notes {
+		fmt.Println("Policy:", note)
+	}
+	return decision, nil
+}
+
+// checkPolicy validates policy section of config. fileNames contains names of certificates described in config.
+func (v *configValidator) checkPolicy(p *SigningPolicy, fileNames map[string]string) {
+	switch p.Mode {
+	case "", policyModeReject, policyModeTrim:
+	default:
+		v.addProblem("policy.mode", "unknown mode %q, must be %s or %s", p.Mode, policyModeReject, policyModeTrim)
+	}
+	for i, algorithm := range p.KeyAlgorithms {
+		known := false
+		for _, knownAlgorithm := range knownKeyAlgorithms {
+			known = known || algorithm == knownAlgorithm
+		}
+		if !known {
+			v.addProblem(fmt.Sprintf("policy.key_algorithms[%d]", i), "unknown key algorithm %q, must be one of %v", algorithm, knownKeyAlgorithms)
+		}
+	}
+	if p.MaxValidity.Duration < 0 {
+		v.addProblem("policy.max_validity", "must not be negative")
+	}
+	if _, ok := p.Profiles[p.DefaultProfile]; p.DefaultProfile != "" && !ok {
+		v.addProblem("policy.default_profile", "unknown profile %q", p.DefaultProfile)
+	}
+	var certNames []string
+	for name := range p.CertProfiles {
+		certNames = append(certNames, name)
+	}
+	sort.Strings(certNames)
+	for _, name := range certNames {
+		if _, ok := fileNames[name]; !ok {
+			v.addProblem("policy.cert_profiles."+name, "unknown certificate %q", name)
+		}
+		if _, ok := p.Profiles[p.CertProfiles[name]]; !ok {
+			v.addProblem("policy.cert_profiles."+name, "unknown profile %q", p.CertProfiles[name])
+		}
+	}
+
+	var profileNames []string
+	for name := range p.Profiles {
+		profileNames = append(profileNames, name)
+	}
+	sort.Strings(profileNames)
+	for _, name := range profileNames {
+		profile, path := p.Profiles[name], "policy.profiles."+name+"."
+		for _, patterns := range []struct {
+			key    string
+			values []string
+		}{
+			{"common_names", profile.CommonNames},
+			{"organizations", profile.Organizations},
+			{"sans", profile.SANs},
+		} {
+			for i, pattern := range patterns.values {
+				if _, err := regexp.Compile(pattern); err != nil {
+					v.addProblem(fmt.Sprintf("%s%s[%d]", path, patterns.key, i), "invalid pattern: %v", err)
+				}
+			}
+		}
+		for i, ipRange := range profile.IPRanges {
+			if _, _, err := net.ParseCIDR(ipRange); err != nil {
+				v.addProblem(fmt.Sprintf("%sip_ranges[%d]", path, i), "%v", err)
+			}
+		}
+		if profile.MaxValidity.Duration < 0 {
+			v.addProblem(path+"max_validity", "must not be negative")
+		}
+		if _, err := csrUsage(profile.Usages); len(profile.Usages) > 0 && err != nil {
+			v.addProblem(path+"usages", "%v", err)
+		}
+		v.checkExtraExtensions(path, profile.ExtraExtensions)
+	}
+}
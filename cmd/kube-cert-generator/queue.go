@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/urfave/cli.v2"
+)
+
+// Request states and audit trail actions. Requests are kept in CA dir subdirectory named after their state.
+const (
+	requestPending   = "pending"
+	requestApproved  = "approved"
+	requestDenied    = "denied"
+	requestSubmitted = "submitted"
+)
+
+const requestMetaFileName = "request.json"
+
+var (
+	requestNameFlag = cli.StringFlag{
+		Name:  "as",
+		Usage: "certificate name, CSR file name is used if not set",
+	}
+	operatorFlag = cli.StringFlag{
+		Name:  "user",
+		Usage: "name recorded in audit trail, current user by default",
+	}
+	reasonFlag = cli.StringFlag{
+		Name:  "reason",
+		Usage: "reason of rejection",
+	}
+)
+
+// csrRequest is metadata of submitted CSR
+type csrRequest struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Submitter   string     `json:"submitter"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	DecidedBy   string     `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Serial      string     `json:"serial,omitempty"`
+}
+
+// requestAuditRecord is single line of CA request audit trail
+type requestAuditRecord struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	User   string    `json:"user"`
+	Reason string    `json:"reason,omitempty"`
+	Serial string    `json:"serial,omitempty"`
+}
+
+// requestsDir returns directory of requests with given state
+func requestsDir(cfg *Config, caName, state string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, state)
+}
+
+func requestAuditFile(cfg *Config, caName string) string {
+	return path.Join(cfg.CAConfig.RootDir, caName, "requests.log")
+}
+
+func operatorFromContext(ctx *cli.Context) string {
+	if name := ctx.String(operatorFlag.Name); name != "" {
+		return name
+	}
+	return currentUser()
+}
+
+// currentUser returns name of user running tool, it is recorded as operator when no other name is known
+func currentUser() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+func newRequestID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix), nil
+}
+
+func appendRequestAudit(cfg *Config, caName string, record requestAuditRecord) error {
+	f, err := os.OpenFile(requestAuditFile(cfg, caName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(record)
+}
+
+func writeRequestMeta(dir string, request *csrRequest) error {
+	content, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, requestMetaFileName), content, 0644)
+}
+
+// loadPendingRequest reads pending request metadata and CSR
+func loadPendingRequest(cfg *Config, caName, id string) (*csrRequest, *x509.CertificateRequest, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return nil, nil, fmt.Errorf("invalid request id %q", id)
+	}
+	dir := path.Join(requestsDir(cfg, caName, requestPending), id)
+	content, err := ioutil.ReadFile(path.Join(dir, requestMetaFileName))
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("pending request %s not found in CA %s", id, caName)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var request csrRequest
+	if err := json.Unmarshal(content, &request); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse request %s: %v", id, err)
+	}
+	csr, err := readCSRFile(path.Join(dir, request.Name+".csr"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &request, csr, nil
+}
+
+func readCSRFile(file string) (*x509.CertificateRequest, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseCSR(file, content)
+}
+
+// parseCSR parses PEM encoded CSR and checks its signature, file is only used in errors
+func parseCSR(file string, content []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature in %s: %v", file, err)
+	}
+	return csr, nil
+}
+
+// finishRequest moves request from pending area, updates its metadata and audit trail
+func finishRequest(cfg *Config, caName string, request *csrRequest, operator string) error {
+	now := time.Now().UTC()
+	request.DecidedBy, request.DecidedAt = operator, &now
+	pendingDir := path.Join(requestsDir(cfg, caName, requestPending), request.ID)
+	if err := writeRequestMeta(pendingDir, request); err != nil {
+		return err
+	}
+	if err := createDirIfNotExists(requestsDir(cfg, caName, request.Status)); err != nil {
+		return err
+	}
+	if err := os.Rename(pendingDir, path.Join(requestsDir(cfg, caName, request.Status), request.ID)); err != nil {
+		return err
+	}
+	return appendRequestAudit(cfg, caName, requestAuditRecord{
+		Time:   now,
+		Action: request.Status,
+		ID:     request.ID,
+		Name:   request.Name,
+		User:   operator,
+		Reason: request.Reason,
+		Serial: request.Serial,
+	})
+}
+
+func submitCSRs(cfg *Config, files []string, caName, name, submitter string) error {
+	if name != "" && len(files) > 1 {
+		return fmt.Errorf("--%s can be used with single CSR only", requestNameFlag.Name)
+	}
+	if _, err := os.Stat(caCertFile(cfg, caName)); err != nil {
+		return fmt.Errorf("certificate authority %s not found: %v", caName, err)
+	}
+	configNames, err := cfg.CertNames()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		csr, err := readCSRFile(file)
+		if err != nil {
+			return err
+		}
+		certName := name
+		if certName == "" {
+			certName = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		if certName == "" || certName != filepath.Base(certName) || strings.HasPrefix(certName, ".") {
+			return fmt.Errorf("invalid certificate name %q", certName)
+		}
+		for _, configName := range configNames {
+			if configName == certName {
+				return fmt.Errorf("certificate name %q is used by config, choose another one with --%s", certName, requestNameFlag.Name)
+			}
+		}
+
+		id, err := newRequestID()
+		if err != nil {
+			return err
+		}
+		dir := path.Join(requestsDir(cfg, caName, requestPending), id)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(dir, certName+".csr"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}), 0644); err != nil {
+			return err
+		}
+		request := csrRequest{ID: id, Name: certName, Status: requestPending, Submitter: submitter, SubmittedAt: time.Now().UTC()}
+		if err := writeRequestMeta(dir, &request); err != nil {
+			return err
+		}
+		if err := appendRequestAudit(cfg, caName, requestAuditRecord{Time: request.SubmittedAt, Action: requestSubmitted, ID: id, Name: certName, User: submitter}); err != nil {
+			return err
+		}
+		fmt.Printf("Submitted %s as request %s (%s)\n", file, id, certName)
+	}
+	return nil
+}
+
+func listPending(cfg *Config, caName string) error {
+	entries, err := ioutil.ReadDir(requestsDir(cfg, caName, requestPending))
+	if os.IsNotExist(err) {
+		entries, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		fmt.Println("No pending requests")
+		return nil
+	}
+	for _, id := range ids {
+		request, csr, err := loadPendingRequest(cfg, caName, id)
+		if err != nil {
+			fmt.Printf("%s: %v\n", id, err)
+			continue
+		}
+		algorithm, size := keyAlgorithm(csr.PublicKey)
+		fmt.Printf("%s: %s\n", request.ID, request.Name)
+		fmt.Printf("  Submitted: %s by %s\n", request.SubmittedAt.Format(time.RFC3339), request.Submitter)
+		fmt.Printf("  Subject: %s\n", csr.Subject)
+		fmt.Printf("  Key: %s %d\n", algorithm, size)
+		sans := sanStrings(&x509.Certificate{DNSNames: csr.DNSNames, EmailAddresses: csr.EmailAddresses, IPAddresses: csr.IPAddresses, URIs: csr.URIs})
+		if len(sans) > 0 {
+			fmt.Printf("  SANs: %s\n", strings.Join(sans, ", "))
+		}
+	}
+	return nil
+}
+
+func approveRequests(cfg *Config, ids []string, caName, outputDir, approver string, opts signOptions) error {
+	for _, id := range ids {
+		request, _, err := loadPendingRequest(cfg, caName, id)
+		if err != nil {
+			return err
+		}
+		certFile := path.Join(outputDir, request.Name+".crt")
+		if _, err := os.Stat(certFile); err == nil && !cfg.OverwriteFiles {
+			return fmt.Errorf("cannot approve %s: %s already exists", id, certFile)
+		}
+		csrFile := path.Join(requestsDir(cfg, caName, requestPending), id, request.Name+".csr")
+		opts.Operator = approver
+		if err := signCSRs(cfg, []string{csrFile}, caName, outputDir, opts); err != nil {
+			return fmt.Errorf("cannot approve %s: %v", id, err)
+		}
+		cert, err := readCertFile(certFile)
+		if err != nil {
+			return err
+		}
+		request.Status, request.Serial = requestApproved, indexSerial(cert.SerialNumber)
+		if err := finishRequest(cfg, caName, request, approver); err != nil {
+			return err
+		}
+		fmt.Printf("Request %s approved by %s\n", id, approver)
+	}
+	return nil
+}
+
+func denyRequests(cfg *Config, ids []string, caName, approver, reason string) error {
+	for _, id := range ids {
+		request, _, err := loadPendingRequest(cfg, caName, id)
+		if err != nil {
+			return err
+		}
+		request.Status, request.Reason = requestDenied, reason
+		if err := finishRequest(cfg, caName, request, approver); err != nil {
+			return err
+		}
+		fmt.Printf("Request %s denied by %s: %s\n", id, approver, reason)
+	}
+	return nil
+}
+
+var submitCmd = cli.Command{
+	Name:      "submit",
+	Usage:     "Put certificate signing requests to pending queue of certificate authority",
+	ArgsUsage: "<csr files>",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&requestNameFlag,
+		&operatorFlag,
+	},
+	Before: initConfig,
+	Action: func(ctx *cli.Context) error {
+		return submitCSRs(ctx.App.Metadata[configContextKey].(*Config), ctx.Args().Slice(), ctx.String(caNameFlag.Name), ctx.String(requestNameFlag.Name), operatorFromContext(ctx))
+	},
+}
+
+var listPendingCmd = cli.Command{
+	Name:  "list-pending",
+	Usage: "Show certificate signing requests waiting for approval",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+	},
+	Before: initConfig,
+	Action: func(ctx *cli.Context) error {
+		return listPending(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name))
+	},
+}
+
+var approveCmd = cli.Command{
+	Name:      "approve",
+	Usage:     "Sign pending certificate signing requests",
+	ArgsUsage: "<request ids>",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+		&operatorFlag,
+		&profileFlag,
+		&outputsFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if err := initConfig(ctx); err != nil {
+			return err
+		}
+		return initOutputDir(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		return approveRequests(ctx.App.Metadata[configContextKey].(*Config), ctx.Args().Slice(), ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string), operatorFromContext(ctx), signOptions{
+			Outputs:        ctx.StringSlice(outputsFlag.Name),
+			PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+			PKCS12Password: passwordFromContext(ctx, true),
+			Profile:        ctx.String(profileFlag.Name),
+		})
+	},
+}
+
+var denyCmd = cli.Command{
+	Name:      "deny",
+	Usage:     "Reject pending certificate signing requests",
+	ArgsUsage: "<request ids>",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&operatorFlag,
+		&reasonFlag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if ctx.String(reasonFlag.Name) == "" {
+			return fmt.Errorf("--%s must be specified", reasonFlag.Name)
+		}
+		return initConfig(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		return denyRequests(ctx.App.Metadata[configContextKey].(*Config), ctx.Args().Slice(), ctx.String(caNameFlag.Name), operatorFromContext(ctx), ctx.String(reasonFlag.Name))
+	},
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// Kinds of differences between config and issued certificates
+const (
+	driftMissing = "missing"
+	driftSubject = "subject"
+	driftSANs    = "sans"
+	driftUsage   = "usage"
+	driftWrongCA = "wrong-ca"
+	driftOrphan  = "orphan"
+)
+
+// certDrift describes single difference between config and certificate on disk
+type certDrift struct {
+	Name    string
+	Kind    string
+	Message string
+}
+
+func (d certDrift) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Name, d.Kind, d.Message)
+}
+
+var fixFlag = cli.BoolFlag{
+	Name:  "fix",
+	Usage: "reissue missing and outdated certificates, revoke and archive orphaned ones",
+}
+
+var reconcileCmd = cli.Command{
+	Name:  "reconcile",
+	Usage: "Compare certificates on disk with config and CA store and report differences",
+	Flags: []cli.Flag{
+		&fixFlag,
+		&caNameFlag,
+		&configFlag,
+		&outputDirFlag,
+		&outputsFlag,
+		&passwordFlag,
+		&passwordFileFlag,
+		&legacyPKCS12Flag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if err := initConfig(ctx); err != nil {
+			return err
+		}
+		return initOutputDir(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		cfg, caName, outputDir := ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string)
+		drifts, err := findCertDrifts(cfg, caName, outputDir)
+		if err != nil {
+			return err
+		}
+		for _, drift := range drifts {
+			fmt.Println(drift)
+		}
+		if len(drifts) == 0 {
+			fmt.Println("Certificates match config")
+			return nil
+		}
+		if !ctx.Bool(fixFlag.Name) {
+			return fmt.Errorf("found %d difference(s), run with --%s to fix them", len(drifts), fixFlag.Name)
+		}
+		return fixCertDrifts(cfg, drifts, caName, outputDir, signOptions{
+			Outputs:        ctx.StringSlice(outputsFlag.Name),
+			PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+			PKCS12Password: passwordFromContext(ctx, true),
+		})
+	},
+}
+
+func sanStrings(cert *x509.Certificate) []string {
+	var ret []string
+	ret = append(ret, cert.DNSNames...)
+	ret = append(ret, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		ret = append(ret, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		ret = append(ret, uri.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func extKeyUsageSet(usages []x509.ExtKeyUsage) map[x509.ExtKeyUsage]bool {
+	ret := make(map[x509.ExtKeyUsage]bool)
+	for _, usage := range usages {
+		ret[usage] = true
+	}
+	return ret
+}
+
+// expectedIssue returns subject and SANs certificate for spec has after signing policy is applied.
+// Values trimmed by policy must not be reported as drift, otherwise --fix reissues certificate on every run.
+func expectedIssue(cfg *Config, spec generator.CertSpec, cert *x509.Certificate) *generator.Issue {
+	csr := &x509.CertificateRequest{
+		Subject:        spec.Params.ToPKIXName(),
+		DNSNames:       spec.Params.DNSNames,
+		EmailAddresses: spec.Params.EmailAddresses,
+		IPAddresses:    spec.Params.IPAddresses,
+		URIs:           spec.Params.URLs,
+		PublicKey:      cert.PublicKey,
+	}
+	ret := generator.NewIssue(csr, spec.Usage, spec.Params.ValidityPeriod)
+	if cfg.Policy == nil {
+		return ret
+	}
+	// config which violates policy can not be signed anyway, so it is compared as is
+	if decision, err := cfg.Policy.apply(cfg.Policy.profileFor(spec.Name), csr, ret.Validity); err == nil {
+		return &decision.Issue
+	}
+	return ret
+}
+
+// specDrifts compares certificate with parameters it should be issued with
+func specDrifts(spec generator.CertSpec, expected *generator.Issue, cert *x509.Certificate, ca *signingCA) []certDrift {
+	var ret []certDrift
+	if expected.Subject.String() != cert.Subject.String() {
+		ret = append(ret, certDrift{Name: spec.Name, Kind: driftSubject, Message: fmt.Sprintf("subject %q, expected %q", cert.Subject, expected.Subject.String())})
+	}
+
+	expectedCert := x509.Certificate{
+		DNSNames:       expected.DNSNames,
+		EmailAddresses: expected.EmailAddresses,
+		IPAddresses:    expected.IPAddresses,
+		URIs:           expected.URIs,
+	}
+	if actual, expectedSANs := sanStrings(cert), sanStrings(&expectedCert); strings.Join(actual, ",") != strings.Join(expectedSANs, ",") {
+		ret = append(ret, certDrift{Name: spec.Name, Kind: driftSANs, Message: fmt.Sprintf("SANs %v, expected %v", actual, expectedSANs)})
+	}
+
+	actualUsage, expectedUsage := extKeyUsageSet(cert.ExtKeyUsage), extKeyUsageSet(spec.Usage.ExtKeyUsage())
+	if len(actualUsage) != len(expectedUsage) {
+		ret = append(ret, certDrift{Name: spec.Name, Kind: driftUsage, Message: "extended key usage does not match certificate role"})
+	} else {
+		for usage := range expectedUsage {
+			if !actualUsage[usage] {
+				ret = append(ret, certDrift{Name: spec.Name, Kind: driftUsage, Message: "extended key usage does not match certificate role"})
+				break
+			}
+		}
+	}
+
+	if err := cert.CheckSignatureFrom(ca.Cert); err != nil {
+		ret = append(ret, certDrift{Name: spec.Name, Kind: driftWrongCA, Message: fmt.Sprintf("issued by %q, expected %q", cert.Issuer, ca.Cert.Subject)})
+	}
+	return ret
+}
+
+// findCertDrifts compares certificates in outputDir with ones which should be issued for config
+func findCertDrifts(cfg *Config, caName, outputDir string) ([]certDrift, error) {
+	specs, err := cfg.CertSpecs()
+	if err != nil {
+		return nil, err
+	}
+	signers := make(map[string]*signingCA)
+	known := make(map[string]bool)
+	var ret []certDrift
+	for _, spec := range specs {
+		known[spec.Name] = true
+		certFile := path.Join(outputDir, spec.Name+".crt")
+		cert, err := readCertFile(certFile)
+		if os.IsNotExist(err) {
+			ret = append(ret, certDrift{Name: spec.Name, Kind: driftMissing, Message: fmt.Sprintf("%s not found", certFile)})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		signerName := cfg.CAName(spec.CA, caName)
+		ca, ok := signers[signerName]
+		if !ok {
+			if ca, err = loadSigningCA(cfg, signerName); err != nil {
+				return nil, err
+			}
+			signers[signerName] = ca
+		}
+		ret = append(ret, specDrifts(spec, expectedIssue(cfg, spec, cert), cert, ca)...)
+	}
+
+	certFiles, err := filepath.Glob(path.Join(outputDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(certFiles)
+	for _, certFile := range certFiles {
+		if name := strings.TrimSuffix(filepath.Base(certFile), ".crt"); !known[name] {
+			ret = append(ret, certDrift{Name: name, Kind: driftOrphan, Message: "certificate is not described in config"})
+		}
+	}
+	return ret, nil
+}
+
+// fixCertDrifts reissues missing and outdated certificates and revokes orphaned ones.
+// Replaced files are moved to archive.
+func fixCertDrifts(cfg *Config, drifts []certDrift, caName, outputDir string, opts signOptions) error {
+	specs, err := cfg.CertSpecs()
+	if err != nil {
+		return err
+	}
+	specsByName := make(map[string]generator.CertSpec)
+	for _, spec := range specs {
+		specsByName[spec.Name] = spec
+	}
+
+	archiveDir := path.Join(outputDir, archiveDirName, "reconcile-"+time.Now().UTC().Format("20060102150405"))
+	handled := make(map[string]bool)
+	var reissue []generator.CertSpec
+	for _, drift := range drifts {
+		if handled[drift.Name] {
+			continue
+		}
+		handled[drift.Name] = true
+		if drift.Kind != driftMissing {
+			if err := revokeAndArchive(cfg, drift.Name, outputDir, archiveDir); err != nil {
+				return err
+			}
+		}
+		if drift.Kind != driftOrphan {
+			reissue = append(reissue, specsByName[drift.Name])
+		}
+	}
+	if len(reissue) == 0 {
+		return nil
+	}
+	fmt.Println("Reissue certificates")
+	return issueCerts(cfg, reissue, caName, outputDir, opts)
+}
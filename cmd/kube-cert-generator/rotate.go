@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"github.com/google/easypki/pkg/certificate"
+	"github.com/google/easypki/pkg/easypki"
+	"gopkg.in/urfave/cli.v2"
+)
+
+const caBundleFileName = "ca-bundle.pem"
+
+var newCANameFlag = cli.StringFlag{
+	Name:  "new-name",
+	Usage: "Name of certificate authority which replaces the current one",
+}
+
+var rotateCAFlags = []cli.Flag{
+	&caNameFlag,
+	&newCANameFlag,
+	&configFlag,
+	&outputDirFlag,
+	&passwordFlag,
+	&passwordFileFlag,
+	&legacyPKCS12Flag,
+}
+
+func rotateCABefore(ctx *cli.Context) error {
+	if ctx.String(newCANameFlag.Name) == "" {
+		return fmt.Errorf("--%s must be specified", newCANameFlag.Name)
+	}
+	if ctx.String(newCANameFlag.Name) == ctx.String(caNameFlag.Name) {
+		return fmt.Errorf("--%s must differ from --%s", newCANameFlag.Name, caNameFlag.Name)
+	}
+	if err := initConfig(ctx); err != nil {
+		return err
+	}
+	return initOutputDir(ctx)
+}
+
+var rotateCACmd = cli.Command{
+	Name:  "rotate-ca",
+	Usage: "Replace certificate authority without downtime",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "start",
+			Usage:  "Create new CA, cross-sign it with the current one and write trust bundle with both CAs",
+			Flags:  rotateCAFlags,
+			Before: rotateCABefore,
+			Action: func(ctx *cli.Context) error {
+				return startCARotation(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.String(newCANameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string))
+			},
+		},
+		{
+			Name:   "reissue",
+			Usage:  "Sign certificates from config issued by the current CA with new CA, certificates of other CAs from [ca_names] are skipped",
+			Flags:  rotateCAFlags,
+			Before: rotateCABefore,
+			Action: func(ctx *cli.Context) error {
+				return reissueCerts(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.String(newCANameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string), signOptions{
+					PKCS12Encoder:  pkcs12Encoder(ctx.Bool(legacyPKCS12Flag.Name)),
+					PKCS12Password: passwordFromContext(ctx, true),
+				})
+			},
+		},
+		{
+			Name:   "finish",
+			Usage:  "Write trust bundle with new CA only and drop cross-signed certificate from chains",
+			Flags:  rotateCAFlags,
+			Before: rotateCABefore,
+			Action: func(ctx *cli.Context) error {
+				return finishCARotation(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name), ctx.String(newCANameFlag.Name), ctx.App.Metadata[outputDirContextKey].(string))
+			},
+		},
+	},
+}
+
+// crossSignedCAFile returns path of new CA certificate issued by old CA. While it exists it is added
+// to chains of certificates signed by new CA.
+func crossSignedCAFile(cfg *Config, newCAName, oldCAName string) string {
+	return path.Join(cfg.CAConfig.RootDir, newCAName, fmt.Sprintf("cross-signed-by-%s.pem", oldCAName))
+}
+
+// crossSign issues certificate of new CA by old CA and records it in old CA index like any other issued certificate
+func crossSign(cfg *Config, oldCAName string, oldCA *certificate.Bundle, newCAName string, newCA *certificate.Bundle) ([]byte, error) {
+	g, issuer := newGenerator(cfg, nil, ""), &generator.CA{Name: oldCAName, Cert: oldCA.Cert, Key: oldCA.Key}
+	serial, err := g.Serial(issuer)
+	if err != nil {
+		return nil, err
+	}
+	template := *newCA.Cert
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().UTC()
+	if template.NotAfter.After(oldCA.Cert.NotAfter) {
+		template.NotAfter = oldCA.Cert.NotAfter
+	}
+	if len(oldCA.Cert.SubjectKeyId) == 0 {
+		if template.AuthorityKeyId, err = generator.SubjectKeyID(oldCA.Cert.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	cfg.CAConfig.Extensions.ApplyIssuer(&template, oldCAName)
+	der, err := x509.CreateCertificate(rand.Reader, &template, oldCA.Cert, newCA.Key.Public(), oldCA.Key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.OnIssued(&generator.Issued{CA: issuer, Name: newCAName, Cert: cert}); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// rotatedCARole returns role of rotated CA. [ca_names] is checked for both names because it may already
+// point to new CA when rotation is finished.
+func rotatedCARole(cfg *Config, oldCAName, newCAName string) generator.CARole {
+	for _, role := range []generator.CARole{generator.CAEtcd, generator.CAFrontProxy} {
+		if name := cfg.CAName(role, ""); name == oldCAName || name == newCAName {
+			return role
+		}
+	}
+	return generator.CAMain
+}
+
+// caBundleFile returns name of trust bundle written while CA with given role is rotated
+func caBundleFile(role generator.CARole) string {
+	switch role {
+	case generator.CAEtcd:
+		return "etcd-" + caBundleFileName
+	case generator.CAFrontProxy:
+		return "front-proxy-" + caBundleFileName
+	default:
+		return caBundleFileName
+	}
+}
+
+func writeCABundle(outputDir, fileName string, cas ...*certificate.Bundle) error {
+	bundleName := path.Join(outputDir, fileName)
+	bundleFile, err := os.Create(bundleName)
+	if err != nil {
+		return err
+	}
+	defer bundleFile.Close()
+	for _, ca := range cas {
+		if err := pem.Encode(bundleFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw}); err != nil {
+			return err
+		}
+	}
+	fmt.Println("CA bundle created:", bundleName)
+	return nil
+}
+
+func startCARotation(cfg *Config, oldCAName, newCAName, outputDir string) error {
+	pki := easypki.EasyPKI{Store: getCAStore(cfg, "")}
+	oldCA, err := pki.GetCA(oldCAName)
+	if err != nil {
+		return err
+	}
+	role, newCACfg := rotatedCARole(cfg, oldCAName, newCAName), *cfg
+	if role != generator.CAMain {
+		// special purpose CAs are named after themselves, see Generator.InitCA
+		newCACfg.CAConfig.CommonName = newCAName
+	} else if oldCA.Cert.Subject.CommonName == newCACfg.CAConfig.CommonName {
+		// clients look up issuer certificates by subject so it must differ
+		newCACfg.CAConfig.CommonName = fmt.Sprintf("%s (%s)", newCACfg.CAConfig.CommonName, newCAName)
+	}
+	if err := initCA(&newCACfg, newCAName, ""); err != nil {
+		return err
+	}
+	newCA, err := pki.GetCA(newCAName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Cross-sign", newCAName, "with", oldCAName)
+	crossSigned, err := crossSign(cfg, oldCAName, oldCA, newCAName, newCA)
+	if err != nil {
+		return fmt.Errorf("failed to cross-sign certificate authority: %v", err)
+	}
+	crossSignedName := crossSignedCAFile(cfg, newCAName, oldCAName)
+	crossSignedFile, err := os.Create(crossSignedName)
+	if err != nil {
+		return err
+	}
+	defer crossSignedFile.Close()
+	if err := pem.Encode(crossSignedFile, &pem.Block{Type: "CERTIFICATE", Bytes: crossSigned}); err != nil {
+		return err
+	}
+	fmt.Println("Cross-signed cert created:", crossSignedName)
+
+	if err := writeCABundle(outputDir, caBundleFile(role), newCA, oldCA); err != nil {
+		return err
+	}
+	fmt.Println("Distribute CA bundle to all nodes and run \"rotate-ca reissue\"")
+	return nil
+}
+
+// reissueCerts signs certificates of old CA with new CA. Certificates of other CAs (etcd and front proxy CAs
+// from [ca_names]) are skipped, they are rotated by running rotate-ca with their names.
+func reissueCerts(cfg *Config, oldCAName, newCAName, outputDir string, opts signOptions) error {
+	specs, err := cfg.CertSpecs()
+	if err != nil {
+		return err
+	}
+	role, reissueCfg := rotatedCARole(cfg, oldCAName, newCAName), *cfg
+	switch role {
+	case generator.CAEtcd:
+		reissueCfg.CANames.Etcd = newCAName
+	case generator.CAFrontProxy:
+		reissueCfg.CANames.FrontProxy = newCAName
+	}
+	var files []string
+	for _, spec := range specs {
+		// roles without CA in [ca_names] are signed by main CA
+		specRole := spec.CA
+		if cfg.CAName(specRole, "") == "" {
+			specRole = generator.CAMain
+		}
+		if specRole != role {
+			fmt.Println("Skip", spec.Name, "- it is signed by", cfg.CAName(specRole, "main CA"), "which is rotated separately")
+			continue
+		}
+		csrFile := path.Join(outputDir, spec.Name+".csr")
+		if _, err := os.Stat(csrFile); err != nil {
+			fmt.Println("WARNING: skip", spec.Name, "-", err)
+			continue
+		}
+		files = append(files, csrFile)
+	}
+
+	reissueCfg.OverwriteFiles = true
+	if err := signCSRs(&reissueCfg, files, newCAName, outputDir, opts); err != nil {
+		return err
+	}
+	if role != generator.CAMain {
+		fmt.Printf("Replace %s with %s in [ca_names] of config before signing new certificates\n", oldCAName, newCAName)
+	}
+	fmt.Println("Distribute new certificates to all nodes and run \"rotate-ca finish\"")
+	return nil
+}
+
+func finishCARotation(cfg *Config, oldCAName, newCAName, outputDir string) error {
+	pki := easypki.EasyPKI{Store: getCAStore(cfg, "")}
+	newCA, err := pki.GetCA(newCAName)
+	if err != nil {
+		return err
+	}
+	role := rotatedCARole(cfg, oldCAName, newCAName)
+	if err := writeCABundle(outputDir, caBundleFile(role), newCA); err != nil {
+		return err
+	}
+	// copy of cross-signed certificate is kept in index of old CA
+	crossSignedName := crossSignedCAFile(cfg, newCAName, oldCAName)
+	if err := os.Remove(crossSignedName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Println("Cross-signed cert removed from chains:", crossSignedName)
+	if role != generator.CAMain {
+		fmt.Printf("Distribute CA bundle to all nodes, then certificate authority %s is no longer needed; set %s in [ca_names] of config\n", oldCAName, newCAName)
+		return nil
+	}
+	fmt.Printf("Distribute CA bundle to all nodes, then certificate authority %s is no longer needed; use --name %s for signing\n", oldCAName, newCAName)
+	return nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+// APIClient is client of signing API
+type APIClient struct {
+	Name        string   `toml:"name" yaml:"name" json:"name"`
+	TokenSHA256 string   `toml:"token_sha256" yaml:"token_sha256" json:"token_sha256"` // hex SHA-256 of token sent as "Authorization: Bearer <token>"
+	CertSHA256  []string `toml:"cert_sha256" yaml:"cert_sha256" json:"cert_sha256"`    // hex SHA-256 fingerprints of client certificates issued by served CA
+	Profiles    []string `toml:"profiles" yaml:"profiles" json:"profiles"`             // signing profiles client may use, first one is default
+	Revoke      bool     `toml:"revoke" yaml:"revoke" json:"revoke"`                   // client may revoke certificates
+}
+
+// APIConfig configures signing API started by serve command
+type APIConfig struct {
+	Clients []APIClient `toml:"client" yaml:"client" json:"client"`
+}
+
+const apiPrefix = "/api/v1/cfssl/"
+
+var (
+	listenFlag = cli.StringFlag{
+		Name:  "listen",
+		Usage: "address to listen on",
+		Value: "127.0.0.1:8888",
+	}
+	tlsCertFlag = cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "server certificate file",
+	}
+	tlsKeyFlag = cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "server private key file",
+	}
+)
+
+var serveCmd = cli.Command{
+	Name:  "serve",
+	Usage: "Serve certificate authority over HTTPS API compatible with cfssl",
+	Flags: []cli.Flag{
+		&caNameFlag,
+		&configFlag,
+		&listenFlag,
+		&tlsCertFlag,
+		&tlsKeyFlag,
+	},
+	Before: func(ctx *cli.Context) error {
+		if ctx.String(tlsCertFlag.Name) == "" || ctx.String(tlsKeyFlag.Name) == "" {
+			return fmt.Errorf("--%s and --%s must be specified", tlsCertFlag.Name, tlsKeyFlag.Name)
+		}
+		return initConfig(ctx)
+	},
+	Action: func(ctx *cli.Context) error {
+		server, err := newAPIServer(ctx.App.Metadata[configContextKey].(*Config), ctx.String(caNameFlag.Name))
+		if err != nil {
+			return err
+		}
+		return server.listen(ctx.String(listenFlag.Name), ctx.String(tlsCertFlag.Name), ctx.String(tlsKeyFlag.Name))
+	},
+}
+
+// apiMessage is error or informational message in API response
+type apiMessage struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiResponse is envelope of all API responses
+type apiResponse struct {
+	Success  bool         `json:"success"`
+	Result   interface{}  `json:"result"`
+	Errors   []apiMessage `json:"errors"`
+	Messages []apiMessage `json:"messages"`
+}
+
+type apiSignRequest struct {
+	CertificateRequest string `json:"certificate_request"`
+	Profile            string `json:"profile"`
+}
+
+type apiSerialRequest struct {
+	Serial string `json:"serial"`
+	Reason string `json:"reason"`
+}
+
+type apiCertificateResult struct {
+	Certificate string `json:"certificate"`
+}
+
+// apiError is error returned to client with HTTP status
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+type apiServer struct {
+	cfg    *Config
+	caName string
+	ca     *signingCA
+	mu     sync.Mutex // serializes writes to CA index
+}
+
+func newAPIServer(cfg *Config, caName string) (*apiServer, error) {
+	if cfg.Policy == nil || len(cfg.API.Clients) == 0 {
+		return nil, fmt.Errorf("signing API requires policy profiles and api clients in config")
+	}
+	ca, err := loadSigningCA(cfg, caName)
+	if err != nil {
+		return nil, err
+	}
+	return &apiServer{cfg: cfg, caName: caName, ca: ca}, nil
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"info", s.wrap(s.handleInfo))
+	mux.HandleFunc(apiPrefix+"sign", s.wrap(s.handleSign))
+	mux.HandleFunc(apiPrefix+"certinfo", s.wrap(s.handleCertInfo))
+	mux.HandleFunc(apiPrefix+"revoke", s.wrap(s.handleRevoke))
+	return mux
+}
+
+func (s *apiServer) listen(address, certFile, keyFile string) error {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(s.ca.Cert)
+	server := http.Server{
+		Addr:    address,
+		Handler: s.handler(),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  clientCAs,
+		},
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	fmt.Printf("Serve certificate authority %s on https://%s%s\n", s.caName, address, apiPrefix)
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+type apiHandler func(r *http.Request) (result interface{}, messages []string, err error)
+
+func (s *apiServer) wrap(handler apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, messages, err := handler(r)
+		resp := apiResponse{Success: err == nil, Result: result, Errors: []apiMessage{}, Messages: []apiMessage{}}
+		status := http.StatusOK
+		if err != nil {
+			apiErr, ok := err.(*apiError)
+			if !ok {
+				log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+				apiErr = newAPIError(http.StatusInternalServerError, "%s", http.StatusText(http.StatusInternalServerError))
+			}
+			status = apiErr.Status
+			resp.Errors = append(resp.Errors, apiMessage{Code: status, Message: apiErr.Message})
+		}
+		for _, message := range messages {
+			resp.Messages = append(resp.Messages, apiMessage{Code: http.StatusOK, Message: message})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// authenticate finds API client by verified TLS client certificate or bearer token
+func (s *apiServer) authenticate(r *http.Request) (*APIClient, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		revoked, err := isRevoked(s.cfg, s.caName, cert.SerialNumber)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, newAPIError(http.StatusForbidden, "client certificate is revoked")
+		}
+		// served CA signs certificates with any subject for API clients, so clients are pinned by fingerprint
+		fingerprint := generator.CertFingerprint(cert)
+		for i, client := range s.cfg.API.Clients {
+			for _, pinned := range client.CertSHA256 {
+				if normalizeFingerprint(pinned) == fingerprint {
+					return &s.cfg.API.Clients[i], nil
+				}
+			}
+		}
+		return nil, newAPIError(http.StatusForbidden, "client certificate %q with fingerprint %s is not allowed", cert.Subject.CommonName, fingerprint)
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		sum := sha256.Sum256([]byte(token))
+		for i, client := range s.cfg.API.Clients {
+			expected, err := hex.DecodeString(client.TokenSHA256)
+			if err == nil && len(expected) == len(sum) && subtle.ConstantTimeCompare(expected, sum[:]) == 1 {
+				return &s.cfg.API.Clients[i], nil
+			}
+		}
+		return nil, newAPIError(http.StatusUnauthorized, "invalid token")
+	}
+	return nil, newAPIError(http.StatusUnauthorized, "client certificate or bearer token required")
+}
+
+// normalizeFingerprint converts fingerprint printed by openssl to form returned by generator.CertFingerprint
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
+func decodeAPIRequest(r *http.Request, req interface{}) error {
+	if r.Method != http.MethodPost {
+		return newAPIError(http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(req); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid request: %v", err)
+	}
+	return nil
+}
+
+func parseAPISerial(serial string) (*big.Int, error) {
+	ret, ok := new(big.Int).SetString(strings.Replace(serial, ":", "", -1), 16)
+	if !ok {
+		return nil, newAPIError(http.StatusBadRequest, "invalid serial %q", serial)
+	}
+	return ret, nil
+}
+
+// handleInfo returns CA certificate chain, it does not require authentication
+func (s *apiServer) handleInfo(r *http.Request) (interface{}, []string, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return nil, nil, newAPIError(http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+	}
+	certs := s.ca.Chain.Issuers()
+	if s.ca.Chain.Root != nil {
+		certs = append(certs, s.ca.Chain.Root)
+	}
+	return apiCertificateResult{Certificate: string(encodeCerts(certs...))}, nil, nil
+}
+
+func (s *apiServer) handleSign(r *http.Request) (interface{}, []string, error) {
+	client, err := s.authenticate(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var req apiSignRequest
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return nil, nil, err
+	}
+	profile := req.Profile
+	if profile == "" && len(client.Profiles) > 0 {
+		profile = client.Profiles[0]
+	}
+	allowed := false
+	for _, clientProfile := range client.Profiles {
+		allowed = allowed || clientProfile == profile
+	}
+	if !allowed {
+		return nil, nil, newAPIError(http.StatusForbidden, "profile %q is not allowed for client %s", profile, client.Name)
+	}
+
+	block, _ := pem.Decode([]byte(req.CertificateRequest))
+	if block == nil {
+		return nil, nil, newAPIError(http.StatusBadRequest, "certificate_request must be PEM encoded CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusBadRequest, "invalid CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, nil, newAPIError(http.StatusBadRequest, "invalid CSR signature: %v", err)
+	}
+	decision, err := s.cfg.Policy.apply(profile, csr, s.cfg.ValidityPeriod.Duration)
+	if err != nil {
+		log.Printf("client %s: CSR for %q rejected by signing policy: %v", client.Name, csr.Subject, err)
+		return nil, nil, newAPIError(http.StatusForbidden, "rejected by signing policy: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cert, err := issueCert(s.cfg, s.ca, s.caName, "api:"+client.Name, csr, decision.Usage, decision, client.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("client %s: signed %q with profile %s, serial %s", client.Name, cert.Subject, profile, indexSerial(cert.SerialNumber))
+	return apiCertificateResult{Certificate: string(encodeCerts(cert))}, decision.Notes, nil
+}
+
+func (s *apiServer) handleCertInfo(r *http.Request) (interface{}, []string, error) {
+	if _, err := s.authenticate(r); err != nil {
+		return nil, nil, err
+	}
+	var req apiSerialRequest
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return nil, nil, err
+	}
+	serial, err := parseAPISerial(req.Serial)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := readIssuedCert(s.cfg, s.caName, serial)
+	if os.IsNotExist(err) {
+		return nil, nil, newAPIError(http.StatusNotFound, "certificate with serial %s not found", req.Serial)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return apiCertificateResult{Certificate: string(encodeCerts(cert))}, nil, nil
+}
+
+func (s *apiServer) handleRevoke(r *http.Request) (interface{}, []string, error) {
+	client, err := s.authenticate(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !client.Revoke {
+		return nil, nil, newAPIError(http.StatusForbidden, "client %s is not allowed to revoke certificates", client.Name)
+	}
+	var req apiSerialRequest
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return nil, nil, err
+	}
+	serial, err := parseAPISerial(req.Serial)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := readIssuedCert(s.cfg, s.caName, serial)
+	if os.IsNotExist(err) {
+		return nil, nil, newAPIError(http.StatusNotFound, "certificate with serial %s not found", req.Serial)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := revokeCert(s.cfg, s.caName, indexSerial(serial), cert, client.Name); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("client %s: revoked serial %s, reason: %s", client.Name, indexSerial(serial), req.Reason)
+	return map[string]string{}, nil, nil
+}
+
+// checkAPI validates api section of config
+func (v *configValidator) checkAPI(api APIConfig, policy *SigningPolicy) {
+	for i, client := range api.Clients {
+		path := fmt.Sprintf("api.client[%d].", i)
+		v.checkName(path+"name", client.Name)
+		if client.TokenSHA256 == "" && len(client.CertSHA256) == 0 {
+			v.addProblem(path+"token_sha256", "token_sha256 or cert_sha256 must be set")
+		}
+		if sum, err := hex.DecodeString(client.TokenSHA256); client.TokenSHA256 != "" && (err != nil || len(sum) != sha256.Size) {
+			v.addProblem(path+"token_sha256", "must be hex encoded SHA-256 hash")
+		}
+		for j, fingerprint := range client.CertSHA256 {
+			if sum, err := hex.DecodeString(normalizeFingerprint(fingerprint)); err != nil || len(sum) != sha256.Size {
+				v.addProblem(fmt.Sprintf("%scert_sha256[%d]", path, j), "must be hex encoded SHA-256 fingerprint")
+			}
+		}
+		if len(client.Profiles) == 0 {
+			v.addProblem(path+"profiles", "must be set")
+		}
+		for j, profile := range client.Profiles {
+			if policy == nil {
+				v.addProblem(fmt.Sprintf("%sprofiles[%d]", path, j), "signing policy is not configured")
+			} else if _, ok := policy.Profiles[profile]; !ok {
+				v.addProblem(fmt.Sprintf("%sprofiles[%d]", path, j), "unknown profile %q", profile)
+			}
+		}
+	}
+}
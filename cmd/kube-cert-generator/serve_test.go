@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+)
+
+const testAPIToken = "secret"
+
+// newTestAPIServer creates CA in temporary dir and starts signing API for client "ci" with bearer token testAPIToken
+func newTestAPIServer(t *testing.T) *httptest.Server {
+	sum := sha256.Sum256([]byte(testAPIToken))
+	cfg := &Config{
+		Policy: &SigningPolicy{Profiles: map[string]SigningProfile{
+			"node": {CommonNames: []string{"system:node:.+"}, Organizations: []string{"system:nodes"}},
+			"admin": {
+				CommonNames:   []string{"admin"},
+				Organizations: []string{"system:masters"},
+				Usages:        []string{"client auth"},
+			},
+		}},
+		API: APIConfig{Clients: []APIClient{
+			{Name: "ci", TokenSHA256: hex.EncodeToString(sum[:]), Profiles: []string{"node", "admin"}},
+		}},
+	}
+	cfg.KeySize = 2048
+	cfg.ValidityPeriod = generator.Duration{Duration: 24 * time.Hour}
+	cfg.CAConfig.RootDir = t.TempDir()
+	if err := initCA(cfg, "root", ""); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newAPIServer(cfg, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testCSR(t *testing.T, cn, o string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn, Organization: []string{o}},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+// postSign sends sign request and returns HTTP status with decoded response
+func postSign(t *testing.T, server *httptest.Server, token string, req apiSignRequest) (int, apiResponse, *x509.Certificate) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, server.URL+apiPrefix+"sign", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := server.Client().Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ret apiResponse
+	var result apiCertificateResult
+	ret.Result = &result
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		t.Fatal(err)
+	}
+	if result.Certificate == "" {
+		return resp.StatusCode, ret, nil
+	}
+	block, _ := pem.Decode([]byte(result.Certificate))
+	if block == nil {
+		t.Fatalf("no certificate in %q", result.Certificate)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, ret, cert
+}
+
+func TestAPISignRequiresAuthentication(t *testing.T) {
+	server := newTestAPIServer(t)
+	for _, token := range []string{"", "wrong"} {
+		status, resp, cert := postSign(t, server, token, apiSignRequest{CertificateRequest: testCSR(t, "system:node:worker-1", "system:nodes")})
+		if status != http.StatusUnauthorized || resp.Success || cert != nil {
+			t.Errorf("token %q: status %d, success %v, expected unauthorized", token, status, resp.Success)
+		}
+	}
+}
+
+func TestAPISignRejectsCSRDeniedByPolicy(t *testing.T) {
+	server := newTestAPIServer(t)
+	status, resp, cert := postSign(t, server, testAPIToken, apiSignRequest{CertificateRequest: testCSR(t, "admin", "system:masters"), Profile: "node"})
+	if status != http.StatusForbidden || cert != nil {
+		t.Fatalf("status %d, expected forbidden without certificate", status)
+	}
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "rejected by signing policy") {
+		t.Errorf("errors %+v", resp.Errors)
+	}
+
+	status, _, _ = postSign(t, server, testAPIToken, apiSignRequest{CertificateRequest: testCSR(t, "admin", "system:masters"), Profile: "unknown"})
+	if status != http.StatusForbidden {
+		t.Errorf("status %d for profile not allowed for client, expected forbidden", status)
+	}
+}
+
+func TestAPISignTakesUsageFromProfile(t *testing.T) {
+	server := newTestAPIServer(t)
+	for _, test := range []struct {
+		profile, cn, o string
+		usages         []x509.ExtKeyUsage
+	}{
+		{"node", "system:node:worker-1", "system:nodes", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}},
+		{"admin", "admin", "system:masters", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+	} {
+		status, resp, cert := postSign(t, server, testAPIToken, apiSignRequest{CertificateRequest: testCSR(t, test.cn, test.o), Profile: test.profile})
+		if status != http.StatusOK || !resp.Success || cert == nil {
+			t.Fatalf("profile %s: status %d, errors %+v", test.profile, status, resp.Errors)
+		}
+		if cert.Subject.CommonName != test.cn {
+			t.Errorf("profile %s: subject %s", test.profile, cert.Subject)
+		}
+		if len(cert.ExtKeyUsage) != len(test.usages) {
+			t.Errorf("profile %s: usages %v, expected %v", test.profile, cert.ExtKeyUsage, test.usages)
+			continue
+		}
+		for i, usage := range test.usages {
+			if cert.ExtKeyUsage[i] != usage {
+				t.Errorf("profile %s: usages %v, expected %v", test.profile, cert.ExtKeyUsage, test.usages)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+var (
+	recipientFlag = cli.StringSliceFlag{
+		Name:  "recipient",
+		Usage: "age (age1...) or SSH public key to encrypt output archive to, output must end with .age",
+	}
+	recipientsFileFlag = cli.StringFlag{
+		Name:  "recipients-file",
+		Usage: "path to file with age public keys to encrypt output archive to, one per line",
+	}
+	passphraseFileFlag = cli.StringFlag{
+		Name:  "passphrase-file",
+		Usage: "path to file containing archive passphrase, used instead of recipients",
+	}
+)
+
+// outputSinkFlags are added to commands which can write output to archive
+var outputSinkFlags = []cli.Flag{
+	&recipientFlag,
+	&recipientsFileFlag,
+	&passphraseFileFlag,
+}
+
+// recipientsFromContext returns recipients of encrypted output archive
+func recipientsFromContext(ctx *cli.Context) ([]age.Recipient, error) {
+	var ret []age.Recipient
+	for _, value := range ctx.StringSlice(recipientFlag.Name) {
+		recipient, err := generator.ParseRecipient(value)
+		if err != nil {
+			return nil, fmt.Errorf("--%s: %v", recipientFlag.Name, err)
+		}
+		ret = append(ret, recipient)
+	}
+	if file := ctx.String(recipientsFileFlag.Name); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		recipients, err := age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		ret = append(ret, recipients...)
+	}
+	if file := ctx.String(passphraseFileFlag.Name); file != "" {
+		// age does not allow passphrase to be mixed with other recipients
+		if len(ret) > 0 {
+			return nil, fmt.Errorf("--%s cannot be used together with recipients", passphraseFileFlag.Name)
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		recipient, err := age.NewScryptRecipient(strings.TrimRight(string(content), "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, recipient)
+	}
+	return ret, nil
+}
+
+// isArchiveOutput reports whether output target is archive rather than directory
+func isArchiveOutput(target string) bool {
+	_, ok := generator.ArchiveFormatFromName(target)
+	return ok || strings.HasSuffix(strings.ToLower(target), generator.EncryptedSuffix)
+}
+
+// withOutputSink opens output target given on command line, runs fn and closes target.
+// Archive is removed if fn fails so incomplete archives are never left behind.
+func withOutputSink(ctx *cli.Context, fn func(sink generator.Sink, target string) error) error {
+	target := ctx.App.Metadata[outputDirContextKey].(string)
+	recipients, err := recipientsFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	sink, err := generator.OpenSink(target, recipients, ctx.App.Metadata[configContextKey].(*Config).OverwriteFiles)
+	if err != nil {
+		return err
+	}
+	err = fn(sink, target)
+	if closeErr := sink.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to write %s: %v", target, closeErr)
+	}
+	if !isArchiveOutput(target) {
+		return err
+	}
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+	fmt.Println("Archive created:", target)
+	return nil
+}
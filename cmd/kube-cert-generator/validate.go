@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/containerum/kube-cert-generator/pkg/cert"
+	"github.com/containerum/kube-cert-generator/pkg/generator"
+	"gopkg.in/urfave/cli.v2"
+)
+
+const minKeySize = 2048
+
+// ConfigProblem describes single problem found in config
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+type configValidator struct {
+	problems []ConfigProblem
+}
+
+func (v *configValidator) addProblem(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *configValidator) checkCertConfig(path string, cfg generator.CertConfig, caValidity Duration) {
+	switch {
+	case cfg.KeySize == 0:
+		v.addProblem(path+"key_size", "must be set")
+	case cfg.KeySize < minKeySize:
+		v.addProblem(path+"key_size", "key size %d is too small, minimum is %d", cfg.KeySize, minKeySize)
+	}
+	switch {
+	case cfg.ValidityPeriod.Duration <= 0:
+		v.addProblem(path+"validity_period", "must be positive")
+	case caValidity.Duration > 0 && cfg.ValidityPeriod.Duration > caValidity.Duration:
+		v.addProblem(path+"validity_period", "validity period %v is longer than CA validity period %v", cfg.ValidityPeriod.Duration, caValidity.Duration)
+	}
+	v.checkExtraExtensions(path, cfg.ExtraExtensions)
+}
+
+func (v *configValidator) checkExtraExtensions(path string, e generator.ExtraExtensions) {
+	seen := make(map[string]bool)
+	for i, custom := range e.CustomExtensions {
+		key := fmt.Sprintf("%scustom_extensions[%d]", path, i)
+		ext, err := custom.Extension()
+		if err != nil {
+			v.addProblem(key, "%v", err)
+			continue
+		}
+		if seen[ext.Id.String()] {
+			v.addProblem(key, "extension %s is declared more than once", ext.Id)
+		}
+		seen[ext.Id.String()] = true
+	}
+	for i, policy := range e.CertificatePolicies {
+		if _, err := generator.ParseOID(policy); err != nil {
+			v.addProblem(fmt.Sprintf("%scertificate_policies[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+func (v *configValidator) checkOutputs(path string, outputs []string) {
+	for i, output := range outputs {
+		if !isKnownOutput(output) {
+			v.addProblem(fmt.Sprintf("%s[%d]", path, i), "unknown output %q, must be one of %v", output, knownOutputs)
+		}
+	}
+}
+
+func (v *configValidator) checkAddresses(path string, host cert.Host) {
+	for i, address := range host.Addresses {
+		if err := cert.CheckAddress(address); err != nil {
+			v.addProblem(fmt.Sprintf("%saddresses[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+func (v *configValidator) checkRecipients(path string, host cert.Host) {
+	for i, recipient := range host.Recipients {
+		if _, err := generator.ParseRecipient(recipient); err != nil {
+			v.addProblem(fmt.Sprintf("%srecipients[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+// checkExtensions validates extension URLs and name constraints and checks that constraints allow SANs of all certificates
+func (v *configValidator) checkExtensions(path string, e generator.Extensions, specs []generator.CertSpec) {
+	for _, urls := range []struct {
+		key    string
+		values []string
+	}{
+		{"ocsp_servers", e.OCSPServers},
+		{"issuing_certificate_urls", e.IssuingCertificateURLs},
+		{"crl_distribution_points", e.CRLDistributionPoints},
+	} {
+		for i, value := range urls.values {
+			if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+				v.addProblem(fmt.Sprintf("%s%s[%d]", path, urls.key, i), "invalid URL %q", value)
+			}
+		}
+	}
+	var ca x509.Certificate
+	if err := e.ApplyNameConstraints(&ca); err != nil {
+		v.addProblem(path+"name_constraints", "%v", err)
+		return
+	}
+	for _, spec := range specs {
+		sans := spec.Params.SubjectAdditionalNames
+		if err := generator.CheckNameConstraints(&ca, sans.DNSNames, sans.IPAddresses); err != nil {
+			v.addProblem(path+"name_constraints", "certificate %s: %v", spec.Name, err)
+		}
+	}
+}
+
+func (v *configValidator) checkName(path, name string) {
+	if name == "" {
+		v.addProblem(path, "must be set")
+	}
+}
+
+// checkFileNames checks that certificates generated for config do not overwrite each other.
+// It returns map of file names to config entries which use them.
+func (v *configValidator) checkFileNames(specs []generator.CertSpec) map[string]string {
+	fileNames := make(map[string]string)
+	reported := make(map[[2]string]bool)
+	for _, spec := range specs {
+		usedBy := spec.ConfigPath
+		if usedBy == "" {
+			usedBy = "standard kubernetes certificate"
+		}
+		if previous, exists := fileNames[spec.Name]; exists {
+			if conflict := [2]string{usedBy, previous}; previous != usedBy && !reported[conflict] {
+				v.addProblem(usedBy, "certificate file name %q is already used by %s", spec.Name, previous)
+				reported[conflict] = true
+			}
+			continue
+		}
+		fileNames[spec.Name] = usedBy
+	}
+	return fileNames
+}
+
+// checkAlias checks that node alias is set and is not used by another node listed in aliases
+func (v *configValidator) checkAlias(aliases map[string]string, path, alias string) {
+	v.checkName(path, alias)
+	if alias == "" {
+		return
+	}
+	if previous, exists := aliases[alias]; exists {
+		v.addProblem(path, "duplicate alias %q, also used by %s", alias, previous)
+		return
+	}
+	aliases[alias] = path
+}
+
+// ValidateConfig checks config and returns all found problems
+func ValidateConfig(cfg *Config, unknownKeys []string) []ConfigProblem {
+	var v configValidator
+	for _, key := range unknownKeys {
+		v.addProblem(key, "unknown key")
+	}
+
+	caCertConfig := cfg.CACertConfig()
+	v.checkCertConfig("ca.", caCertConfig, Duration{})
+	switch cfg.CAConfig.SerialMode {
+	case "", generator.SerialRandom, generator.SerialSequential:
+	default:
+		v.addProblem("ca.serial_mode", "unknown mode %q, must be %s or %s", cfg.CAConfig.SerialMode, generator.SerialRandom, generator.SerialSequential)
+	}
+	v.checkCertConfig("", cfg.CertConfig, caCertConfig.ValidityPeriod)
+	v.checkOutputs("outputs", cfg.Outputs)
+	v.checkAddresses("master_node.", cfg.MasterNode)
+	v.checkRecipients("master_node.", cfg.MasterNode)
+	workerAliases := make(map[string]string)
+	for i, node := range cfg.WorkerNodes {
+		path := fmt.Sprintf("worker_node[%d].", i)
+		v.checkAlias(workerAliases, path+"alias", node.Alias)
+		v.checkAddresses(path, node)
+		v.checkRecipients(path, node)
+	}
+	etcdAliases := make(map[string]string)
+	for i, node := range cfg.EtcdNodes {
+		path := fmt.Sprintf("etcd_node[%d].", i)
+		v.checkAlias(etcdAliases, path+"alias", node.Alias)
+		v.checkAddresses(path, node)
+		v.checkRecipients(path, node)
+	}
+	for i, extraCert := range cfg.ExtraCerts {
+		path := fmt.Sprintf("extra_cert[%d].", i)
+		v.checkName(path+"name", extraCert.Name)
+		v.checkCertConfig(path, extraCert.CertConfig, caCertConfig.ValidityPeriod)
+		v.checkOutputs(path+"outputs", extraCert.Outputs)
+		v.checkAddresses(path+"host.", extraCert.Host)
+		v.checkRecipients(path+"host.", extraCert.Host)
+	}
+	specs, err := cfg.CertSpecs()
+	if err != nil {
+		// certificates can not be described without valid extensions, their problems are already reported
+		if len(v.problems) == 0 {
+			v.addProblem("", "%v", err)
+		}
+		return v.problems
+	}
+	fileNames := v.checkFileNames(specs)
+	v.checkExtensions("ca.extensions.", cfg.CAConfig.Extensions, specs)
+
+	var outputNames []string
+	for name := range cfg.CertOutputsByName {
+		outputNames = append(outputNames, name)
+	}
+	sort.Strings(outputNames)
+	for _, name := range outputNames {
+		if _, exists := fileNames[name]; !exists {
+			v.addProblem("cert_outputs."+name, "unknown certificate %q", name)
+		}
+		v.checkOutputs("cert_outputs."+name, cfg.CertOutputsByName[name])
+	}
+	if cfg.Policy != nil {
+		v.checkPolicy(cfg.Policy, fileNames)
+	}
+	v.checkAPI(cfg.API, cfg.Policy)
+	v.checkRenewal(cfg.Renewal, fileNames)
+	return v.problems
+}
+
+var validateConfigCmd = cli.Command{
+	Name:  "validate-config",
+	Usage: "Check config file and report all found problems",
+	Flags: []cli.Flag{
+		&configFlag,
+	},
+	Action: func(ctx *cli.Context) error {
+		var problems []ConfigProblem
+		cfg, unknownKeys, err := LoadConfig(ctx.String(configFlag.Name))
+		if valuesErr, ok := err.(*configValuesError); ok {
+			problems = valuesErr.Problems
+		} else if err != nil {
+			return err
+		} else {
+			problems = ValidateConfig(cfg, unknownKeys)
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d problem(s) in %s", len(problems), ctx.String(configFlag.Name))
+		}
+		fmt.Println("Config is valid")
+		return nil
+	},
+}
@@ -11,17 +11,17 @@ import (
 
 // CommonFields represents common X.509 certificate fields
 type CommonFields struct {
-	CommonName string `toml:"common_name"`
+	CommonName string `toml:"common_name" yaml:"common_name" json:"common_name"`
 
-	Country          []string `toml:"country"`
-	Organization     []string `toml:"organization"`
-	OrganizationUnit []string `toml:"organization_unit"`
+	Country          []string `toml:"country" yaml:"country" json:"country"`
+	Organization     []string `toml:"organization" yaml:"organization" json:"organization"`
+	OrganizationUnit []string `toml:"organization_unit" yaml:"organization_unit" json:"organization_unit"`
 
-	Locality []string `toml:"locality"`
-	Province []string `toml:"province"`
+	Locality []string `toml:"locality" yaml:"locality" json:"locality"`
+	Province []string `toml:"province" yaml:"province" json:"province"`
 
-	StreetAddress []string `toml:"street_address"`
-	PostalCode    []string `toml:"postal_code"`
+	StreetAddress []string `toml:"street_address" yaml:"street_address" json:"street_address"`
+	PostalCode    []string `toml:"postal_code" yaml:"postal_code" json:"postal_code"`
 }
 
 func (c *CommonFields) ToPKIXName() pkix.Name {
@@ -40,6 +40,7 @@ func (c *CommonFields) ToPKIXName() pkix.Name {
 type Params struct {
 	ValidityPeriod time.Duration
 	KeySize        int
+	Extensions     []pkix.Extension // additional extensions requested in CSR and put to certificate
 
 	CommonFields
 	SubjectAdditionalNames
@@ -51,11 +52,12 @@ func (c *Params) GenKey() (*rsa.PrivateKey, error) {
 
 func (c *Params) CSRTemplate() *x509.CertificateRequest {
 	return &x509.CertificateRequest{
-		Subject:        c.CommonFields.ToPKIXName(),
-		DNSNames:       c.DNSNames,
-		EmailAddresses: c.EmailAddresses,
-		IPAddresses:    c.IPAddresses,
-		URIs:           c.URLs,
+		Subject:         c.CommonFields.ToPKIXName(),
+		DNSNames:        c.DNSNames,
+		EmailAddresses:  c.EmailAddresses,
+		IPAddresses:     c.IPAddresses,
+		URIs:            c.URLs,
+		ExtraExtensions: c.Extensions,
 	}
 }
 
@@ -65,9 +67,10 @@ func (c *Params) CACertTemplate() *x509.Certificate {
 		NotBefore:             time.Now().UTC(),
 		NotAfter:              time.Now().Add(c.ValidityPeriod).UTC(),
 		BasicConstraintsValid: true,
-		IsCA:     true,
-		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment,
-		Subject:  c.ToPKIXName(),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment,
+		Subject:               c.ToPKIXName(),
+		ExtraExtensions:       c.Extensions,
 	}
 }
 
@@ -87,5 +90,6 @@ func (c *Params) CertTemplate() *x509.Certificate {
 		DNSNames:              c.DNSNames,
 		URIs:                  c.URLs,
 		EmailAddresses:        c.EmailAddresses,
+		ExtraExtensions:       c.Extensions,
 	}
 }
@@ -1,7 +1,9 @@
 package cert
 
 import (
+	"fmt"
 	"net"
+	"net/mail"
 	"net/url"
 	"regexp"
 	"strings"
@@ -16,13 +18,16 @@ type SubjectAdditionalNames struct {
 
 // Host represents single worker node
 type Host struct {
-	Alias     string   `toml:"alias"`
-	Addresses []string `toml:"addresses"`
+	Alias     string   `toml:"alias" yaml:"alias" json:"alias"`
+	Addresses []string `toml:"addresses" yaml:"addresses" json:"addresses"`
+	// Recipients are public keys (age or ssh-ed25519) which node files are encrypted to
+	Recipients []string `toml:"recipients" yaml:"recipients" json:"recipients"`
 }
 
 var (
 	ipv4regex = regexp.MustCompile(`\b((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)(\.|$)){4}\b`)
 	ipv6regex = regexp.MustCompile(`(([0-9a-fA-F]{1,4}:){7,7}[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,7}:|([0-9a-fA-F]{1,4}:){1,6}:[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,5}(:[0-9a-fA-F]{1,4}){1,2}|([0-9a-fA-F]{1,4}:){1,4}(:[0-9a-fA-F]{1,4}){1,3}|([0-9a-fA-F]{1,4}:){1,3}(:[0-9a-fA-F]{1,4}){1,4}|([0-9a-fA-F]{1,4}:){1,2}(:[0-9a-fA-F]{1,4}){1,5}|[0-9a-fA-F]{1,4}:((:[0-9a-fA-F]{1,4}){1,6})|:((:[0-9a-fA-F]{1,4}){1,7}|:)|fe80:(:[0-9a-fA-F]{0,4}){0,4}%[0-9a-zA-Z]{1,}|::(ffff(:0{1,4}){0,1}:){0,1}((25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9])\.){3,3}(25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9])|([0-9a-fA-F]{1,4}:){1,4}:((25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9])\.){3,3}(25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9]))`)
+	dnsregex  = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
 )
 
 func (host Host) ToSANs() SubjectAdditionalNames {
@@ -34,7 +39,7 @@ func (host Host) ToSANs() SubjectAdditionalNames {
 			ret.EmailAddresses = append(ret.EmailAddresses, hostAddr)
 		case ipv4regex.MatchString(hostAddr) || ipv6regex.MatchString(hostAddr):
 			ret.IPAddresses = append(ret.IPAddresses, net.ParseIP(hostAddr))
-		case urlParseErr != nil:
+		case urlParseErr == nil && urlAddr.Scheme != "":
 			ret.URLs = append(ret.URLs, urlAddr)
 		default:
 			ret.DNSNames = append(ret.DNSNames, hostAddr)
@@ -42,3 +47,27 @@ func (host Host) ToSANs() SubjectAdditionalNames {
 	}
 	return ret
 }
+
+// CheckAddress reports whether address can be put into certificate SANs the same way ToSANs does it.
+func CheckAddress(address string) error {
+	switch {
+	case address == "":
+		return fmt.Errorf("empty address")
+	case strings.Contains(address, "@"):
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("invalid email address %q: %v", address, err)
+		}
+	case ipv4regex.MatchString(address) || ipv6regex.MatchString(address) || strings.Trim(address, "0123456789.") == "":
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid IP address %q", address)
+		}
+	default:
+		if urlAddr, err := url.Parse(address); err == nil && urlAddr.Scheme != "" {
+			return nil
+		}
+		if len(address) > 253 || !dnsregex.MatchString(address) {
+			return fmt.Errorf("invalid DNS name %q", address)
+		}
+	}
+	return nil
+}
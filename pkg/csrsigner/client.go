@@ -0,0 +1,144 @@
+package csrsigner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Client reads and updates CertificateSigningRequest objects
+type Client interface {
+	// List returns CSRs addressed to signer
+	List(ctx context.Context, signerName string) ([]CertificateSigningRequest, error)
+	// UpdateStatus writes status of CSR, it fails if CSR was changed since it was read
+	UpdateStatus(ctx context.Context, csr *CertificateSigningRequest) error
+}
+
+const (
+	csrResourcePath = "/apis/certificates.k8s.io/v1/certificatesigningrequests"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// RESTClient is Client which calls Kubernetes API server
+type RESTClient struct {
+	Server    string // API server URL
+	TokenFile string // bearer token file, it is read for every request because projected tokens are rotated
+	HTTP      *http.Client
+}
+
+// NewRESTClient creates client for API server. Empty caFile means system roots, empty tokenFile disables authentication.
+func NewRESTClient(server, tokenFile, caFile string) (*RESTClient, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		content, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return &RESTClient{
+		Server:    strings.TrimSuffix(server, "/"),
+		TokenFile: tokenFile,
+		HTTP: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// NewInClusterClient creates client using service account of pod
+func NewInClusterClient() (*RESTClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	return NewRESTClient("https://"+net.JoinHostPort(host, port), path.Join(serviceAccountDir, "token"), path.Join(serviceAccountDir, "ca.crt"))
+}
+
+func (c *RESTClient) do(ctx context.Context, method, uri, contentType string, body []byte, ret interface{}) error {
+	req, err := http.NewRequest(method, c.Server+uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.TokenFile != "" {
+		token, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		// API server returns Status object with message
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(content, &status) == nil && status.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, uri, resp.Status, status.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, uri, resp.Status)
+	}
+	if ret == nil {
+		return nil
+	}
+	return json.Unmarshal(content, ret)
+}
+
+// List returns CSRs addressed to signer
+func (c *RESTClient) List(ctx context.Context, signerName string) ([]CertificateSigningRequest, error) {
+	var list struct {
+		Items []CertificateSigningRequest `json:"items"`
+	}
+	query := url.Values{"fieldSelector": {"spec.signerName=" + signerName}}
+	if err := c.do(ctx, http.MethodGet, csrResourcePath+"?"+query.Encode(), "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// UpdateStatus patches status subresource of CSR. Resource version is sent so concurrent changes are detected.
+func (c *RESTClient) UpdateStatus(ctx context.Context, csr *CertificateSigningRequest) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": csr.Metadata.ResourceVersion},
+		"status":   csr.Status,
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	var updated CertificateSigningRequest
+	if err := c.do(ctx, http.MethodPatch, csrResourcePath+"/"+url.PathEscape(csr.Metadata.Name)+"/status", "application/merge-patch+json", body, &updated); err != nil {
+		return err
+	}
+	*csr = updated
+	return nil
+}
@@ -0,0 +1,202 @@
+package csrsigner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Responses in testdata are in the form kube-apiserver returns them for certificates.k8s.io/v1:
+// list.json for list with field selector, status-patched.json for merge patch of status
+// subresource and conflict.json for patch with outdated resource version.
+
+const apiSignerName = "containerum.com/kube-cert-generator"
+
+func readTestdata(t *testing.T, name string) []byte {
+	content, err := ioutil.ReadFile(path.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// newTestRESTClient starts API server with handler and returns client authenticated with bearer token "secret"
+func newTestRESTClient(t *testing.T, handler http.HandlerFunc) *RESTClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	tokenFile := path.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &RESTClient{Server: server.URL, TokenFile: tokenFile, HTTP: server.Client()}
+}
+
+// serveList responds to list request with list.json
+func serveList(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != csrResourcePath {
+		t.Errorf("list path %s, expected %s", r.URL.Path, csrResourcePath)
+	}
+	if selector := r.URL.Query().Get("fieldSelector"); selector != "spec.signerName="+apiSignerName {
+		t.Errorf("field selector %q", selector)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(readTestdata(t, "list.json"))
+}
+
+func TestRESTClientListDecodesAPIServerResponse(t *testing.T) {
+	client := newTestRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+		}
+		serveList(t, w, r)
+	})
+	csrs, err := client.List(context.Background(), apiSignerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(csrs) != 2 {
+		t.Fatalf("listed %d CSRs, expected 2", len(csrs))
+	}
+
+	approved := csrs[0]
+	if approved.Metadata.Name != "csr-approved" || approved.Metadata.ResourceVersion != "48190" {
+		t.Errorf("metadata %+v", approved.Metadata)
+	}
+	if !approved.Pending() || csrs[1].Pending() {
+		t.Errorf("pending %v, %v, expected only approved CSR to be pending", approved.Pending(), csrs[1].Pending())
+	}
+	if expiration := approved.Expiration(); expiration != 24*time.Hour {
+		t.Errorf("expiration %v, expected 24h", expiration)
+	}
+	if approved.Spec.Username != "system:bootstrap:abcdef" || len(approved.Spec.Usages) != 2 {
+		t.Errorf("spec %+v", approved.Spec)
+	}
+	if condition := approved.Status.Conditions[0]; condition.LastTransitionTime != "2024-03-05T10:12:58Z" {
+		t.Errorf("condition %+v lost transition time", condition)
+	}
+	req, err := approved.ParseRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Subject.CommonName != "system:node:worker-1" {
+		t.Errorf("request subject %s", req.Subject)
+	}
+}
+
+func TestControllerSignsCSRThroughRESTClient(t *testing.T) {
+	var patches int
+	client := newTestRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			serveList(t, w, r)
+		case http.MethodPatch:
+			patches++
+			if expected := csrResourcePath + "/csr-approved/status"; r.URL.Path != expected {
+				t.Errorf("patch path %s, expected %s", r.URL.Path, expected)
+			}
+			if contentType := r.Header.Get("Content-Type"); contentType != "application/merge-patch+json" {
+				t.Errorf("patch content type %s", contentType)
+			}
+			var patch struct {
+				Metadata ObjectMeta                      `json:"metadata"`
+				Status   CertificateSigningRequestStatus `json:"status"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				t.Error(err)
+				return
+			}
+			// resource version makes API server refuse patch of CSR changed since list
+			if patch.Metadata.ResourceVersion != "48190" {
+				t.Errorf("patch resource version %q, expected 48190", patch.Metadata.ResourceVersion)
+			}
+			if string(patch.Status.Certificate) != string(testCertificate) {
+				t.Errorf("patched certificate %q", patch.Status.Certificate)
+			}
+			// merge patch replaces conditions list, so approval must be sent back unchanged
+			if len(patch.Status.Conditions) != 1 || patch.Status.Conditions[0].Type != ConditionApproved ||
+				patch.Status.Conditions[0].LastTransitionTime == "" {
+				t.Errorf("patched conditions %+v", patch.Status.Conditions)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(readTestdata(t, "status-patched.json"))
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+		}
+	})
+
+	var signed []string
+	controller := newTestController(client, testSigner(&signed))
+	controller.SignerName = apiSignerName
+	result, err := controller.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{Signed: 1}) {
+		t.Errorf("sync result %+v, expected one signed", result)
+	}
+	if len(signed) != 1 || signed[0] != "csr-approved" || patches != 1 {
+		t.Errorf("signed %v with %d patches, expected only csr-approved", signed, patches)
+	}
+}
+
+func TestRESTClientReportsConflictStatus(t *testing.T) {
+	client := newTestRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			serveList(t, w, r)
+		case http.MethodPatch:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			w.Write(readTestdata(t, "conflict.json"))
+		}
+	})
+	csrs, err := client.List(context.Background(), apiSignerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.UpdateStatus(context.Background(), &csrs[0])
+	if err == nil || !strings.Contains(err.Error(), "409") || !strings.Contains(err.Error(), "the object has been modified") {
+		t.Errorf("error %v, expected conflict with API server message", err)
+	}
+	if csrs[0].Metadata.ResourceVersion != "48190" {
+		t.Errorf("CSR is changed after failed update: %+v", csrs[0].Metadata)
+	}
+
+	var signed []string
+	controller := newTestController(client, testSigner(&signed))
+	controller.SignerName = apiSignerName
+	result, err := controller.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{Errors: 1}) {
+		t.Errorf("sync result %+v, expected conflict counted as error", result)
+	}
+}
+
+func TestRESTClientSendsBearerToken(t *testing.T) {
+	client := newTestRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		serveList(t, w, r)
+	})
+	client.TokenFile = path.Join(t.TempDir(), "missing")
+	if _, err := client.List(context.Background(), apiSignerName); err == nil {
+		t.Error("list succeeded without token file")
+	}
+	client.TokenFile = ""
+	if _, err := client.List(context.Background(), apiSignerName); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("error %v, expected 401 without token", err)
+	}
+}
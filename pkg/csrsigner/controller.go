@@ -0,0 +1,140 @@
+package csrsigner
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// Signer issues certificate for approved CSR
+type Signer interface {
+	// Sign returns PEM encoded certificate chain. Requests which must never be signed are reported with *RejectedError,
+	// other errors are retried on next sync.
+	Sign(csr *CertificateSigningRequest, req *x509.CertificateRequest) ([]byte, error)
+}
+
+// SignerFunc adapts function to Signer
+type SignerFunc func(csr *CertificateSigningRequest, req *x509.CertificateRequest) ([]byte, error)
+
+// Sign calls f
+func (f SignerFunc) Sign(csr *CertificateSigningRequest, req *x509.CertificateRequest) ([]byte, error) {
+	return f(csr, req)
+}
+
+// RejectedError marks CSR as failed instead of retrying it
+type RejectedError struct {
+	Reason  string
+	Message string
+}
+
+func (e *RejectedError) Error() string {
+	return e.Reason + ": " + e.Message
+}
+
+// Reject creates RejectedError
+func Reject(reason, format string, args ...interface{}) error {
+	return &RejectedError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Controller signs approved CSRs addressed to SignerName
+type Controller struct {
+	Client     Client
+	SignerName string
+	Signer     Signer
+	Interval   time.Duration                            // resync interval used by Run
+	Logf       func(format string, args ...interface{}) // optional
+	Now        func() time.Time                         // optional, used for condition timestamps
+}
+
+func (c *Controller) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
+func (c *Controller) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// SyncResult counts CSRs handled by single sync
+type SyncResult struct {
+	Signed   int
+	Rejected int
+	Errors   int
+}
+
+// Sync signs or fails every pending CSR once
+func (c *Controller) Sync(ctx context.Context) (SyncResult, error) {
+	var ret SyncResult
+	csrs, err := c.Client.List(ctx, c.SignerName)
+	if err != nil {
+		return ret, fmt.Errorf("failed to list certificate signing requests: %v", err)
+	}
+	for i := range csrs {
+		csr := &csrs[i]
+		// field selector may be ignored by old API servers
+		if csr.Spec.SignerName != c.SignerName || !csr.Pending() {
+			continue
+		}
+		if err := c.handle(ctx, csr); err != nil {
+			if _, ok := err.(*RejectedError); ok {
+				ret.Rejected++
+				continue
+			}
+			ret.Errors++
+			c.logf("%s: %v", csr.Metadata.Name, err)
+			continue
+		}
+		ret.Signed++
+	}
+	return ret, nil
+}
+
+func (c *Controller) handle(ctx context.Context, csr *CertificateSigningRequest) error {
+	req, err := csr.ParseRequest()
+	var certificate []byte
+	if err != nil {
+		err = Reject("InvalidRequest", "%v", err)
+	} else {
+		certificate, err = c.Signer.Sign(csr, req)
+	}
+	if rejected, ok := err.(*RejectedError); ok {
+		c.logf("%s: rejected: %s", csr.Metadata.Name, rejected.Message)
+		csr.setFailed(rejected.Reason, rejected.Message, c.now())
+		if err := c.Client.UpdateStatus(ctx, csr); err != nil {
+			return fmt.Errorf("failed to mark CSR failed: %v", err)
+		}
+		return rejected
+	}
+	if err != nil {
+		return err
+	}
+	csr.Status.Certificate = certificate
+	if err := c.Client.UpdateStatus(ctx, csr); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+	c.logf("%s: signed", csr.Metadata.Name)
+	return nil
+}
+
+// Run syncs every Interval until ctx is done
+func (c *Controller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if result, err := c.Sync(ctx); err != nil {
+			c.logf("%v", err)
+		} else if result.Signed+result.Rejected+result.Errors > 0 {
+			c.logf("signed %d, rejected %d, failed to handle %d", result.Signed, result.Rejected, result.Errors)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
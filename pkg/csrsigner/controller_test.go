@@ -0,0 +1,198 @@
+package csrsigner
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const testSignerName = "example.com/test"
+
+var testCertificate = []byte("-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----\n")
+
+func testRequest(t *testing.T, commonName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func testCSR(t *testing.T, name string, conditions ...string) CertificateSigningRequest {
+	ret := CertificateSigningRequest{
+		Metadata: ObjectMeta{Name: name},
+		Spec: CertificateSigningRequestSpec{
+			Request:    testRequest(t, name),
+			SignerName: testSignerName,
+			Usages:     []string{UsageDigitalSignature, UsageClientAuth},
+		},
+	}
+	for _, condition := range conditions {
+		ret.Status.Conditions = append(ret.Status.Conditions, CertificateSigningRequestCondition{Type: condition, Status: "True"})
+	}
+	return ret
+}
+
+// testSigner signs every request except ones with CN "forbidden" which violate policy
+func testSigner(signed *[]string) Signer {
+	return SignerFunc(func(csr *CertificateSigningRequest, req *x509.CertificateRequest) ([]byte, error) {
+		*signed = append(*signed, csr.Metadata.Name)
+		if req.Subject.CommonName == "forbidden" {
+			return nil, Reject("SigningPolicy", "rejected by signing policy: CN=%s is not allowed", req.Subject.CommonName)
+		}
+		return testCertificate, nil
+	})
+}
+
+func newTestController(client Client, signer Signer) *Controller {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &Controller{
+		Client:     client,
+		SignerName: testSignerName,
+		Signer:     signer,
+		Now:        func() time.Time { return now },
+	}
+}
+
+func TestSyncSignsApprovedCSR(t *testing.T) {
+	var signed []string
+	client := NewFakeClient(testCSR(t, "approved", ConditionApproved))
+	result, err := newTestController(client, testSigner(&signed)).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{Signed: 1}) {
+		t.Errorf("sync result %+v, expected one signed", result)
+	}
+	csr, _ := client.Get("approved")
+	if string(csr.Status.Certificate) != string(testCertificate) {
+		t.Errorf("certificate %q is not written to status", csr.Status.Certificate)
+	}
+	if csr.Pending() {
+		t.Error("signed CSR is still pending")
+	}
+
+	// signed CSR is not signed again
+	result, err = newTestController(client, testSigner(&signed)).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{}) || len(signed) != 1 {
+		t.Errorf("sync result %+v, signed %v after CSR was signed", result, signed)
+	}
+}
+
+func TestSyncSkipsUnapprovedDeniedAndForeignCSRs(t *testing.T) {
+	var signed []string
+	foreign := testCSR(t, "foreign", ConditionApproved)
+	foreign.Spec.SignerName = "kubernetes.io/kube-apiserver-client"
+	client := NewFakeClient(
+		testCSR(t, "pending"),
+		testCSR(t, "denied", ConditionDenied),
+		testCSR(t, "approved-then-denied", ConditionApproved, ConditionDenied),
+		testCSR(t, "failed", ConditionApproved, ConditionFailed),
+		foreign,
+	)
+	result, err := newTestController(client, testSigner(&signed)).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{}) {
+		t.Errorf("sync result %+v, expected nothing handled", result)
+	}
+	if len(signed) != 0 || len(client.Updates) != 0 {
+		t.Errorf("signed %v, updated %d CSRs, expected none", signed, len(client.Updates))
+	}
+}
+
+func TestSyncLeavesCSRViolatingPolicyUnsigned(t *testing.T) {
+	var signed []string
+	invalid := testCSR(t, "invalid", ConditionApproved)
+	invalid.Spec.Request = []byte("not a CSR")
+	client := NewFakeClient(testCSR(t, "forbidden", ConditionApproved), invalid)
+	result, err := newTestController(client, testSigner(&signed)).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{Rejected: 2}) {
+		t.Errorf("sync result %+v, expected two rejected", result)
+	}
+	for name, reason := range map[string]string{"forbidden": "SigningPolicy", "invalid": "InvalidRequest"} {
+		csr, _ := client.Get(name)
+		if len(csr.Status.Certificate) > 0 {
+			t.Errorf("%s: certificate is written for rejected CSR", name)
+		}
+		if !csr.hasCondition(ConditionFailed) {
+			t.Errorf("%s: Failed condition is not set", name)
+			continue
+		}
+		if condition := csr.Status.Conditions[len(csr.Status.Conditions)-1]; condition.Reason != reason {
+			t.Errorf("%s: failure reason %q, expected %q", name, condition.Reason, reason)
+		}
+	}
+
+	// failed CSRs are not retried
+	if result, err = newTestController(client, testSigner(&signed)).Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{}) || len(signed) != 1 {
+		t.Errorf("sync result %+v, signer called for %v after CSRs failed", result, signed)
+	}
+}
+
+func TestSyncRetriesCSRAfterSignerError(t *testing.T) {
+	client := NewFakeClient(testCSR(t, "approved", ConditionApproved))
+	failing := SignerFunc(func(csr *CertificateSigningRequest, req *x509.CertificateRequest) ([]byte, error) {
+		return nil, fmt.Errorf("CA is unavailable")
+	})
+	result, err := newTestController(client, failing).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{Errors: 1}) {
+		t.Errorf("sync result %+v, expected one error", result)
+	}
+	if csr, _ := client.Get("approved"); !csr.Pending() {
+		t.Error("CSR is not pending after transient error")
+	}
+
+	var signed []string
+	if result, err = newTestController(client, testSigner(&signed)).Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{Signed: 1}) {
+		t.Errorf("sync result %+v, expected CSR signed on retry", result)
+	}
+}
+
+func TestSyncReportsConflictingUpdate(t *testing.T) {
+	var signed []string
+	client := NewFakeClient(testCSR(t, "approved", ConditionApproved))
+	client.Conflict["approved"] = true
+	result, err := newTestController(client, testSigner(&signed)).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (SyncResult{Errors: 1}) {
+		t.Errorf("sync result %+v, expected one error", result)
+	}
+	if csr, _ := client.Get("approved"); len(csr.Status.Certificate) > 0 {
+		t.Error("certificate is stored despite conflict")
+	}
+
+	client.ListErr = fmt.Errorf("connection refused")
+	if _, err := newTestController(client, testSigner(&signed)).Sync(context.Background()); err == nil {
+		t.Error("list error is not returned")
+	}
+}
@@ -0,0 +1,82 @@
+package csrsigner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// FakeClient is in-memory Client for tests
+type FakeClient struct {
+	mu       sync.Mutex
+	objects  map[string]CertificateSigningRequest
+	version  int
+	Updates  []CertificateSigningRequest // CSRs passed to UpdateStatus in call order
+	ListErr  error                       // returned by List if set
+	Conflict map[string]bool             // names of CSRs UpdateStatus fails for with conflict
+}
+
+// NewFakeClient creates fake client holding given CSRs
+func NewFakeClient(csrs ...CertificateSigningRequest) *FakeClient {
+	ret := &FakeClient{objects: make(map[string]CertificateSigningRequest), Conflict: make(map[string]bool)}
+	for _, csr := range csrs {
+		ret.Add(csr)
+	}
+	return ret
+}
+
+// Add stores CSR replacing one with same name
+func (c *FakeClient) Add(csr CertificateSigningRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	csr.Metadata.ResourceVersion = strconv.Itoa(c.version)
+	c.objects[csr.Metadata.Name] = csr
+}
+
+// Get returns stored CSR
+func (c *FakeClient) Get(name string) (CertificateSigningRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	csr, ok := c.objects[name]
+	return csr, ok
+}
+
+// List returns CSRs addressed to signer sorted by name
+func (c *FakeClient) List(ctx context.Context, signerName string) ([]CertificateSigningRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ListErr != nil {
+		return nil, c.ListErr
+	}
+	var ret []CertificateSigningRequest
+	for _, csr := range c.objects {
+		if csr.Spec.SignerName == signerName {
+			ret = append(ret, csr)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Metadata.Name < ret[j].Metadata.Name })
+	return ret, nil
+}
+
+// UpdateStatus replaces status of stored CSR
+func (c *FakeClient) UpdateStatus(ctx context.Context, csr *CertificateSigningRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Updates = append(c.Updates, *csr)
+	stored, ok := c.objects[csr.Metadata.Name]
+	if !ok {
+		return fmt.Errorf("certificatesigningrequest %q not found", csr.Metadata.Name)
+	}
+	if c.Conflict[csr.Metadata.Name] || stored.Metadata.ResourceVersion != csr.Metadata.ResourceVersion {
+		return fmt.Errorf("certificatesigningrequest %q was modified", csr.Metadata.Name)
+	}
+	c.version++
+	stored.Status = csr.Status
+	stored.Metadata.ResourceVersion = strconv.Itoa(c.version)
+	c.objects[csr.Metadata.Name] = stored
+	*csr = stored
+	return nil
+}
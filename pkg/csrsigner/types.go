@@ -0,0 +1,120 @@
+// Package csrsigner implements signer for Kubernetes certificates.k8s.io/v1 CertificateSigningRequest objects.
+// It talks to API server over plain REST so it does not depend on client-go.
+package csrsigner
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// CSR condition types
+const (
+	ConditionApproved = "Approved"
+	ConditionDenied   = "Denied"
+	ConditionFailed   = "Failed"
+)
+
+// Key usages which may be requested in CSR spec
+const (
+	UsageDigitalSignature = "digital signature"
+	UsageKeyEncipherment  = "key encipherment"
+	UsageServerAuth       = "server auth"
+	UsageClientAuth       = "client auth"
+)
+
+// ObjectMeta contains object metadata used by signer
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// CertificateSigningRequestSpec is spec of CertificateSigningRequest
+type CertificateSigningRequestSpec struct {
+	Request           []byte   `json:"request"` // PEM encoded CSR
+	SignerName        string   `json:"signerName"`
+	ExpirationSeconds *int32   `json:"expirationSeconds,omitempty"`
+	Usages            []string `json:"usages,omitempty"`
+	Username          string   `json:"username,omitempty"`
+	UID               string   `json:"uid,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+// CertificateSigningRequestCondition describes state of CertificateSigningRequest
+type CertificateSigningRequestCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastUpdateTime     string `json:"lastUpdateTime,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"` // kept so status patch does not drop it from existing conditions
+}
+
+// CertificateSigningRequestStatus is status of CertificateSigningRequest
+type CertificateSigningRequestStatus struct {
+	Conditions  []CertificateSigningRequestCondition `json:"conditions,omitempty"`
+	Certificate []byte                               `json:"certificate,omitempty"` // PEM encoded certificate chain
+}
+
+// CertificateSigningRequest contains fields of certificates.k8s.io/v1 CertificateSigningRequest used by signer
+type CertificateSigningRequest struct {
+	APIVersion string                          `json:"apiVersion,omitempty"`
+	Kind       string                          `json:"kind,omitempty"`
+	Metadata   ObjectMeta                      `json:"metadata"`
+	Spec       CertificateSigningRequestSpec   `json:"spec"`
+	Status     CertificateSigningRequestStatus `json:"status"`
+}
+
+// hasCondition reports whether CSR has condition of given type with status True
+func (csr *CertificateSigningRequest) hasCondition(conditionType string) bool {
+	for _, condition := range csr.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending reports whether CSR is approved and waits for certificate
+func (csr *CertificateSigningRequest) Pending() bool {
+	return csr.hasCondition(ConditionApproved) && !csr.hasCondition(ConditionDenied) && !csr.hasCondition(ConditionFailed) &&
+		len(csr.Status.Certificate) == 0
+}
+
+// Expiration returns requested certificate duration or 0 if it was not requested
+func (csr *CertificateSigningRequest) Expiration() time.Duration {
+	if csr.Spec.ExpirationSeconds == nil {
+		return 0
+	}
+	return time.Duration(*csr.Spec.ExpirationSeconds) * time.Second
+}
+
+// ParseRequest decodes and checks CSR from spec
+func (csr *CertificateSigningRequest) ParseRequest() (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("spec.request must be PEM encoded CERTIFICATE REQUEST")
+	}
+	ret, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := ret.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %v", err)
+	}
+	return ret, nil
+}
+
+// setFailed adds Failed condition to CSR
+func (csr *CertificateSigningRequest) setFailed(reason, message string, now time.Time) {
+	csr.Status.Conditions = append(csr.Status.Conditions, CertificateSigningRequestCondition{
+		Type:               ConditionFailed,
+		Status:             "True",
+		Reason:             reason,
+		Message:            message,
+		LastUpdateTime:     now.UTC().Format(time.RFC3339),
+		LastTransitionTime: now.UTC().Format(time.RFC3339),
+	})
+}
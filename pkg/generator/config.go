@@ -0,0 +1,119 @@
+package generator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/cert"
+)
+
+// Duration is time.Duration which is written in config as string, e.g. "8760h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", string(text))
+	}
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// CertConfig represents certificate creation configuration
+type CertConfig struct {
+	ValidityPeriod Duration `toml:"validity_period" yaml:"validity_period" json:"validity_period"`
+	KeySize        int      `toml:"key_size" yaml:"key_size" json:"key_size"`
+	Outputs        []string `toml:"outputs" yaml:"outputs" json:"outputs"` // additional output formats written by command line tool
+
+	ExtraExtensions `yaml:",inline"`
+}
+
+// ExtraCertConfig represents configuration for creating additional certs
+type ExtraCertConfig struct {
+	Name string `toml:"name" yaml:"name" json:"name"`
+
+	cert.CommonFields `yaml:",inline"`
+	CertConfig        `yaml:",inline"`
+	Host              cert.Host `toml:"host" yaml:"host" json:"host"`
+}
+
+// CAConfig represents configuration for certificate authority
+type CAConfig struct {
+	RootDir    string `toml:"root_dir" yaml:"root_dir" json:"root_dir"`
+	SerialMode string `toml:"serial_mode" yaml:"serial_mode" json:"serial_mode"` // SerialRandom or SerialSequential
+
+	cert.CommonFields `yaml:",inline"`
+	CertConfig        `yaml:",inline"`
+	Extensions        Extensions `toml:"extensions" yaml:"extensions" json:"extensions"`
+}
+
+// CANames represents names of certificate authorities in CA store which sign special purpose certificates.
+// Empty name means that CA given in command line is used.
+type CANames struct {
+	Etcd       string `toml:"etcd" yaml:"etcd" json:"etcd"`
+	FrontProxy string `toml:"front_proxy" yaml:"front_proxy" json:"front_proxy"` // defaults to DefaultFrontProxyCAName
+}
+
+// DefaultFrontProxyCAName is name of CA signing front proxy client certificate.
+// Front proxy CA must not be used for other certificates so it is never replaced by default CA.
+const DefaultFrontProxyCAName = "front-proxy-ca"
+
+// Config describes certificates of Kubernetes cluster
+type Config struct {
+	CommonFields   cert.CommonFields `toml:"common_fields" yaml:"common_fields" json:"common_fields"`
+	OverwriteFiles bool              `toml:"overwrite_files" yaml:"overwrite_files" json:"overwrite_files"`
+	CertConfig     `yaml:",inline"`
+	MasterNode     cert.Host         `toml:"master_node" yaml:"master_node" json:"master_node"`
+	WorkerNodes    []cert.Host       `toml:"worker_node" yaml:"worker_node" json:"worker_node"`
+	EtcdNodes      []cert.Host       `toml:"etcd_node" yaml:"etcd_node" json:"etcd_node"`
+	ExtraCerts     []ExtraCertConfig `toml:"extra_cert" yaml:"extra_cert" json:"extra_cert"`
+	CAConfig       CAConfig          `toml:"ca" yaml:"ca" json:"ca"`
+	CANames        CANames           `toml:"ca_names" yaml:"ca_names" json:"ca_names"`
+}
+
+// CACertConfig returns certificate config of CA. Key size and validity period which are not set
+// in CA section are taken from top level config as before they were supported there.
+func (cfg *Config) CACertConfig() CertConfig {
+	ret := cfg.CAConfig.CertConfig
+	if ret.KeySize == 0 {
+		ret.KeySize = cfg.KeySize
+	}
+	if ret.ValidityPeriod.Duration == 0 {
+		ret.ValidityPeriod = cfg.ValidityPeriod
+	}
+	return ret
+}
+
+// CAName returns name of CA which signs certificates with given role
+func (cfg *Config) CAName(role CARole, defaultName string) string {
+	switch {
+	case role == CAEtcd && cfg.CANames.Etcd != "":
+		return cfg.CANames.Etcd
+	case role == CAFrontProxy && cfg.CANames.FrontProxy != "":
+		return cfg.CANames.FrontProxy
+	case role == CAFrontProxy:
+		return DefaultFrontProxyCAName
+	default:
+		return defaultName
+	}
+}
+
+func CertParamsFromConfig(cfg CertConfig) (cert.Params, error) {
+	extensions, err := cfg.Extensions()
+	if err != nil {
+		return cert.Params{}, err
+	}
+	ret := cert.Params{
+		ValidityPeriod: cfg.ValidityPeriod.Duration,
+		KeySize:        cfg.KeySize,
+		Extensions:     extensions,
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,274 @@
+package generator
+
+import (
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// CAPlaceholder is replaced with name of issuing CA in extension URLs
+const CAPlaceholder = "{ca}"
+
+// Extensions configures standard X.509 extensions of certificate authorities and certificates they issue.
+// Subject and authority key identifiers are always added.
+type Extensions struct {
+	// Authority information access and CRL distribution points put to certificates issued by CA, URLs may contain CAPlaceholder
+	OCSPServers            []string `toml:"ocsp_servers" yaml:"ocsp_servers" json:"ocsp_servers"`
+	IssuingCertificateURLs []string `toml:"issuing_certificate_urls" yaml:"issuing_certificate_urls" json:"issuing_certificate_urls"`
+	CRLDistributionPoints  []string `toml:"crl_distribution_points" yaml:"crl_distribution_points" json:"crl_distribution_points"`
+
+	// Name constraints put to CA certificate, IP ranges are given in CIDR notation
+	PermittedDNSDomains     []string `toml:"permitted_dns_domains" yaml:"permitted_dns_domains" json:"permitted_dns_domains"`
+	ExcludedDNSDomains      []string `toml:"excluded_dns_domains" yaml:"excluded_dns_domains" json:"excluded_dns_domains"`
+	PermittedIPRanges       []string `toml:"permitted_ip_ranges" yaml:"permitted_ip_ranges" json:"permitted_ip_ranges"`
+	ExcludedIPRanges        []string `toml:"excluded_ip_ranges" yaml:"excluded_ip_ranges" json:"excluded_ip_ranges"`
+	NameConstraintsCritical bool     `toml:"name_constraints_critical" yaml:"name_constraints_critical" json:"name_constraints_critical"`
+}
+
+// SubjectKeyID returns SHA-1 of subject public key bit string as described in RFC 5280 4.2.1.2
+func SubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(info.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+func expandCAURLs(urls []string, caName string) []string {
+	var ret []string
+	for _, url := range urls {
+		ret = append(ret, strings.Replace(url, CAPlaceholder, caName, -1))
+	}
+	return ret
+}
+
+// ApplyIssuer sets authority information access and CRL distribution points of certificate issued by CA with given name
+func (e *Extensions) ApplyIssuer(template *x509.Certificate, caName string) {
+	template.OCSPServer = expandCAURLs(e.OCSPServers, caName)
+	template.IssuingCertificateURL = expandCAURLs(e.IssuingCertificateURLs, caName)
+	template.CRLDistributionPoints = expandCAURLs(e.CRLDistributionPoints, caName)
+}
+
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, value := range ranges {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q: %v", value, err)
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret, nil
+}
+
+// ApplyNameConstraints sets name constraints of CA certificate
+func (e *Extensions) ApplyNameConstraints(template *x509.Certificate) error {
+	var err error
+	if template.PermittedIPRanges, err = parseIPRanges(e.PermittedIPRanges); err != nil {
+		return err
+	}
+	if template.ExcludedIPRanges, err = parseIPRanges(e.ExcludedIPRanges); err != nil {
+		return err
+	}
+	template.PermittedDNSDomains, template.ExcludedDNSDomains = e.PermittedDNSDomains, e.ExcludedDNSDomains
+	template.PermittedDNSDomainsCritical = e.NameConstraintsCritical
+	return nil
+}
+
+// matchDomain reports whether domain matches name constraint, constraint starting with dot matches subdomains only
+func matchDomain(domain, constraint string) bool {
+	domain, constraint = strings.ToLower(strings.TrimSuffix(domain, ".")), strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(domain, constraint)
+	}
+	return domain == constraint || strings.HasSuffix(domain, "."+constraint)
+}
+
+func matchIPRanges(ranges []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckNameConstraints checks that DNS names and IP addresses are allowed by name constraints of CA certificate.
+// Certificates with other names would be rejected by clients verifying chain.
+func CheckNameConstraints(ca *x509.Certificate, dnsNames []string, ips []net.IP) error {
+	var violations []string
+	for _, name := range dnsNames {
+		permitted := len(ca.PermittedDNSDomains) == 0
+		for _, constraint := range ca.PermittedDNSDomains {
+			permitted = permitted || matchDomain(name, constraint)
+		}
+		excluded := false
+		for _, constraint := range ca.ExcludedDNSDomains {
+			excluded = excluded || matchDomain(name, constraint)
+		}
+		if !permitted || excluded {
+			violations = append(violations, "DNS name "+name)
+		}
+	}
+	for _, ip := range ips {
+		permitted := len(ca.PermittedIPRanges) == 0 || matchIPRanges(ca.PermittedIPRanges, ip)
+		if !permitted || matchIPRanges(ca.ExcludedIPRanges, ip) {
+			violations = append(violations, "IP address "+ip.String())
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%s not allowed by name constraints", strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// Encodings of custom extension values
+const (
+	EncodingUTF8String = "utf8string" // value is text encoded as ASN.1 UTF8String, default
+	EncodingDER        = "der"        // value is base64 encoded DER
+	EncodingHex        = "hex"        // value is hex encoded DER
+)
+
+var (
+	oidCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidTLSFeature          = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+)
+
+// tlsFeatureStatusRequest is TLS feature requiring stapled OCSP response, RFC 7633
+const tlsFeatureStatusRequest = 5
+
+// CustomExtension declares extension by its OID, value is written as is without checking its syntax
+type CustomExtension struct {
+	OID      string `toml:"oid" yaml:"oid" json:"oid"` // dotted form, e.g. 1.3.6.1.4.1.99999.1
+	Critical bool   `toml:"critical" yaml:"critical" json:"critical"`
+	Encoding string `toml:"encoding" yaml:"encoding" json:"encoding"` // EncodingUTF8String, EncodingDER or EncodingHex
+	Value    string `toml:"value" yaml:"value" json:"value"`
+}
+
+// ExtraExtensions declares extensions added to certificate in addition to standard ones
+type ExtraExtensions struct {
+	CustomExtensions    []CustomExtension `toml:"custom_extensions" yaml:"custom_extensions" json:"custom_extensions"`
+	CertificatePolicies []string          `toml:"certificate_policies" yaml:"certificate_policies" json:"certificate_policies"` // policy OIDs
+	OCSPMustStaple      bool              `toml:"ocsp_must_staple" yaml:"ocsp_must_staple" json:"ocsp_must_staple"`
+}
+
+// ParseOID parses object identifier in dotted form
+func ParseOID(value string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", value)
+	}
+	var ret asn1.ObjectIdentifier
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", value)
+		}
+		ret = append(ret, n)
+	}
+	// first two arcs are encoded as single number 40*first+second, X.690 8.19.4
+	if ret[0] > 2 {
+		return nil, fmt.Errorf("invalid OID %q: first arc must be 0, 1 or 2", value)
+	}
+	if ret[0] < 2 && ret[1] >= 40 {
+		return nil, fmt.Errorf("invalid OID %q: second arc must be less than 40 when first arc is 0 or 1", value)
+	}
+	return ret, nil
+}
+
+// Extension encodes declared extension
+func (e CustomExtension) Extension() (pkix.Extension, error) {
+	oid, err := ParseOID(e.OID)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	ret := pkix.Extension{Id: oid, Critical: e.Critical}
+	switch e.Encoding {
+	case "", EncodingUTF8String:
+		ret.Value, err = asn1.MarshalWithParams(e.Value, "utf8")
+	case EncodingDER:
+		ret.Value, err = base64.StdEncoding.DecodeString(e.Value)
+	case EncodingHex:
+		ret.Value, err = hex.DecodeString(strings.Replace(e.Value, ":", "", -1))
+	default:
+		return pkix.Extension{}, fmt.Errorf("extension %s: unknown encoding %q, must be %s, %s or %s", e.OID, e.Encoding, EncodingUTF8String, EncodingDER, EncodingHex)
+	}
+	if err != nil {
+		return pkix.Extension{}, fmt.Errorf("extension %s: invalid value: %v", e.OID, err)
+	}
+	if e.Encoding == EncodingDER || e.Encoding == EncodingHex {
+		var value asn1.RawValue
+		if rest, err := asn1.Unmarshal(ret.Value, &value); err != nil || len(rest) > 0 {
+			return pkix.Extension{}, fmt.Errorf("extension %s: value is not single DER encoded value", e.OID)
+		}
+	}
+	return ret, nil
+}
+
+// Extensions encodes all declared extensions
+func (e ExtraExtensions) Extensions() ([]pkix.Extension, error) {
+	var ret []pkix.Extension
+	if len(e.CertificatePolicies) > 0 {
+		var policies []struct{ Policy asn1.ObjectIdentifier }
+		for _, value := range e.CertificatePolicies {
+			oid, err := ParseOID(value)
+			if err != nil {
+				return nil, fmt.Errorf("certificate policy: %v", err)
+			}
+			policies = append(policies, struct{ Policy asn1.ObjectIdentifier }{oid})
+		}
+		value, err := asn1.Marshal(policies)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, pkix.Extension{Id: oidCertificatePolicies, Value: value})
+	}
+	if e.OCSPMustStaple {
+		value, err := asn1.Marshal([]int{tlsFeatureStatusRequest})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, pkix.Extension{Id: oidTLSFeature, Value: value})
+	}
+	for _, custom := range e.CustomExtensions {
+		ext, err := custom.Extension()
+		if err != nil {
+			return nil, err
+		}
+		ret = MergeExtensions(ret, []pkix.Extension{ext})
+	}
+	return ret, nil
+}
+
+// MergeExtensions returns base extensions together with extra ones, extra extension replaces base one with the same OID
+func MergeExtensions(base, extra []pkix.Extension) []pkix.Extension {
+	ret := append([]pkix.Extension(nil), base...)
+	for _, ext := range extra {
+		replaced := false
+		for i := range ret {
+			if ret[i].Id.Equal(ext.Id) {
+				ret[i], replaced = ext, true
+			}
+		}
+		if !replaced {
+			ret = append(ret, ext)
+		}
+	}
+	return ret
+}
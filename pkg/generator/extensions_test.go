@@ -0,0 +1,26 @@
+package generator
+
+import "testing"
+
+func TestParseOIDChecksFirstArcs(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"1.3.6.1.4.1.99999.1": true,
+		"2.5.29.32.0":         true,
+		"2.999.1":             true, // second arc is not limited under joint-iso-itu-t
+		"0.39":                true,
+		"1":                   false,
+		"1..2":                false,
+		"1.-2":                false,
+		"3.1.2":               false,
+		"0.40":                false,
+		"1.40.5":              false,
+	} {
+		_, err := ParseOID(value)
+		if valid && err != nil {
+			t.Errorf("%s: %v", value, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%s: expected error", value)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FS stores generated files. Names are slash separated paths relative to FS root.
+type FS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Exists(name string) (bool, error)
+}
+
+// DirFS is FS backed by directory on disk
+type DirFS string
+
+func (d DirFS) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+func (d DirFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(d.path(name))
+}
+
+// WriteFile creates missing parent directories and replaces existing file
+func (d DirFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(d.path(name)), os.ModePerm); err != nil {
+		return err
+	}
+	// remove file first so perm is applied to replaced file too
+	if err := os.Remove(d.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(d.path(name), data, perm)
+}
+
+// Exists reports whether non-empty file exists
+func (d DirFS) Exists(name string) (bool, error) {
+	info, err := os.Stat(d.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Size() > 0, nil
+}
+
+// MemFS is FS which keeps files in memory
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	data []byte
+	perm os.FileMode
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]memFile)}
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), file.data...), nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = memFile{data: append([]byte(nil), data...), perm: perm}
+	return nil
+}
+
+func (m *MemFS) Exists(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.files[name].data) > 0, nil
+}
+
+// Mode returns permissions file was written with
+func (m *MemFS) Mode(name string) os.FileMode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files[name].perm
+}
+
+// Names returns sorted names of stored files
+func (m *MemFS) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ret []string
+	for name := range m.files {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
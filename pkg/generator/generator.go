@@ -0,0 +1,372 @@
+// Package generator creates keys, CSRs and certificates of Kubernetes cluster described by Config.
+// It does not print anything, results of every step are returned to caller.
+//
+//	g := generator.New(cfg, generator.NewMemFS())
+//	ca, err := g.InitCA("root")
+//	...
+//	g.LoadCA = func(name string) (*generator.CA, error) { return ca, nil }
+//	results, err := g.GenerateCSRs()
+//	...
+//	for _, result := range results {
+//		signed, err := g.Sign("root", result.Spec.Name, result.CSR)
+//		...
+//	}
+package generator
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+)
+
+// CA is certificate authority which signs certificates
+type CA struct {
+	Name string
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Issue contains values which are put to signed certificate
+type Issue struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	Usage          CertUsage
+	Validity       time.Duration
+	Extensions     []pkix.Extension // added to certificate, values are not taken from CSR
+	Profile        string           // name of signing profile which produced issue, it is only passed to OnIssued
+}
+
+// NewIssue returns issue which copies subject and SANs from CSR
+func NewIssue(csr *x509.CertificateRequest, usage CertUsage, validity time.Duration) *Issue {
+	return &Issue{
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		Usage:          usage,
+		Validity:       validity,
+	}
+}
+
+// Generator runs generation steps for Config
+type Generator struct {
+	Config *Config
+	FS     FS               // storage of keys, CSRs and certificates
+	Rand   io.Reader        // source of random serial numbers, passed to crypto functions; crypto/rand if nil
+	Now    func() time.Time // time.Now if nil
+
+	// LoadCA returns certificate authority by name, it is required by Sign
+	LoadCA func(name string) (*CA, error)
+	// Authorize is called by Sign before certificate is issued, it may change issue or refuse to sign CSR
+	Authorize func(name string, csr *x509.CertificateRequest, issue *Issue) error
+	// OnIssued is called by Sign and IssueCert for every issued certificate, e.g. to record it in CA index
+	OnIssued func(issued *Issued) error
+	// NextSerial returns serial number of next certificate issued by CA, random serials are used if nil
+	NextSerial func(ca *CA) (*big.Int, error)
+	// SerialExists reports whether CA already issued certificate with serial, such serials are never reused
+	SerialExists func(ca *CA, serial *big.Int) (bool, error)
+}
+
+// Issued describes certificate issued by IssueCert
+type Issued struct {
+	CA    *CA
+	Name  string
+	CSR   *x509.CertificateRequest
+	Issue *Issue
+	Cert  *x509.Certificate
+}
+
+// New creates generator writing files to fs
+func New(cfg *Config, fs FS) *Generator {
+	return &Generator{Config: cfg, FS: fs}
+}
+
+func (g *Generator) rand() io.Reader {
+	if g.Rand != nil {
+		return g.Rand
+	}
+	return rand.Reader
+}
+
+func (g *Generator) now() time.Time {
+	if g.Now != nil {
+		return g.Now()
+	}
+	return time.Now()
+}
+
+// CSRResult describes key and CSR generated for certificate
+type CSRResult struct {
+	Spec       CertSpec
+	KeyFile    string
+	CSRFile    string
+	KeyCreated bool // false if existing key was kept
+	CSRCreated bool // false if existing CSR was kept
+	CSR        *x509.CertificateRequest
+}
+
+// GenerateCSRs creates private keys and CSRs for all certificates described by config
+func (g *Generator) GenerateCSRs() ([]CSRResult, error) {
+	specs, err := g.Config.CertSpecs()
+	if err != nil {
+		return nil, err
+	}
+	var ret []CSRResult
+	for _, spec := range specs {
+		result, err := g.GenerateCSR(spec)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, *result)
+	}
+	return ret, nil
+}
+
+// GenerateCSR creates private key and CSR for certificate. Existing files are kept unless config allows
+// to overwrite them, CSR is created for existing key if it is missing.
+func (g *Generator) GenerateCSR(spec CertSpec) (*CSRResult, error) {
+	ret := &CSRResult{Spec: spec, KeyFile: spec.Name + ".key", CSRFile: spec.Name + ".csr"}
+	keyExists, err := g.FS.Exists(ret.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	csrExists, err := g.FS.Exists(ret.CSRFile)
+	if err != nil {
+		return nil, err
+	}
+	if keyExists && csrExists && !g.Config.OverwriteFiles {
+		return ret, nil
+	}
+
+	var key crypto.Signer
+	if keyExists && !g.Config.OverwriteFiles {
+		content, err := g.FS.ReadFile(ret.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = ParsePrivateKey(content); err != nil {
+			return nil, fmt.Errorf("%s: %v", ret.KeyFile, err)
+		}
+	} else {
+		rsaKey, err := rsa.GenerateKey(g.rand(), spec.Params.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+		if err := g.FS.WriteFile(ret.KeyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		key, ret.KeyCreated = rsaKey, true
+	}
+
+	der, err := x509.CreateCertificateRequest(g.rand(), spec.Params.CSRTemplate(), key)
+	if err != nil {
+		return nil, err
+	}
+	if ret.CSR, err = x509.ParseCertificateRequest(der); err != nil {
+		return nil, err
+	}
+	if err := g.FS.WriteFile(ret.CSRFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+	ret.CSRCreated = true
+	return ret, nil
+}
+
+// ParsePrivateKey parses PEM encoded PKCS#1, PKCS#8 or EC private key
+func ParsePrivateKey(content []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	return signer, nil
+}
+
+// InitCA creates self-signed certificate authority with given name. It is not stored anywhere.
+func (g *Generator) InitCA(name string) (*CA, error) {
+	params, err := CertParamsFromConfig(g.Config.CACertConfig())
+	if err != nil {
+		return nil, err
+	}
+	params.CommonFields = g.Config.CAConfig.CommonFields
+	// clients look up issuer certificates by subject so special purpose CAs must not share it with main CA
+	for _, role := range []CARole{CAEtcd, CAFrontProxy} {
+		if g.Config.CAName(role, "") == name {
+			params.CommonName = name
+		}
+	}
+
+	key, err := rsa.GenerateKey(g.rand(), params.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	template := params.CACertTemplate()
+	// new CA has not issued anything yet so its own serial only has to be unpredictable
+	if template.SerialNumber, err = RandomSerial(g.rand()); err != nil {
+		return nil, err
+	}
+	template.NotBefore = g.now().UTC()
+	template.NotAfter = g.now().Add(params.ValidityPeriod).UTC()
+	if template.SubjectKeyId, err = SubjectKeyID(key.Public()); err != nil {
+		return nil, err
+	}
+	if err := g.Config.CAConfig.Extensions.ApplyNameConstraints(template); err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(g.rand(), template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Name: name, Cert: cert, Key: key}, nil
+}
+
+// IssueCert signs CSR with CA using values from issue
+func (g *Generator) IssueCert(ca *CA, name string, csr *x509.CertificateRequest, issue *Issue) (*x509.Certificate, error) {
+	if err := CheckNameConstraints(ca.Cert, issue.DNSNames, issue.IPAddresses); err != nil {
+		return nil, fmt.Errorf("cannot issue %s by %s: %v", name, ca.Name, err)
+	}
+	serial, err := g.Serial(ca)
+	if err != nil {
+		return nil, err
+	}
+	subjectKeyID, err := SubjectKeyID(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	// x509 takes authority key identifier from CA subject key identifier, CAs created before it was set have none
+	authorityKeyID := ca.Cert.SubjectKeyId
+	if len(authorityKeyID) == 0 {
+		if authorityKeyID, err = SubjectKeyID(ca.Cert.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	// step: create the request template
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Issuer:                ca.Cert.Subject,
+		Subject:               issue.Subject,
+		NotBefore:             g.now().UTC(),
+		NotAfter:              g.now().Add(issue.Validity).UTC(),
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           issue.Usage.ExtKeyUsage(),
+		IPAddresses:           issue.IPAddresses,
+		DNSNames:              issue.DNSNames,
+		EmailAddresses:        issue.EmailAddresses,
+		URIs:                  issue.URIs,
+		SubjectKeyId:          subjectKeyID,
+		AuthorityKeyId:        authorityKeyID,
+		ExtraExtensions:       issue.Extensions,
+	}
+	g.Config.CAConfig.Extensions.ApplyIssuer(&template, ca.Name)
+
+	// step: sign the certificate authority
+	der, err := x509.CreateCertificate(g.rand(), &template, ca.Cert, csr.PublicKey, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate, error: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if g.OnIssued != nil {
+		if err := g.OnIssued(&Issued{CA: ca, Name: name, CSR: csr, Issue: issue, Cert: cert}); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+// SignResult describes certificate signed by Sign
+type SignResult struct {
+	Name     string
+	CertFile string
+	CA       *CA               // nil if certificate was skipped
+	Cert     *x509.Certificate // nil if certificate was skipped
+	Skipped  bool              // certificate exists and config does not allow to overwrite it
+}
+
+// Sign signs CSR of certificate with given name. Usage, validity and CA are taken from config,
+// certificates not described in config are signed by defaultCA for both server and client usage.
+func (g *Generator) Sign(defaultCA, name string, csr *x509.CertificateRequest) (*SignResult, error) {
+	ret := &SignResult{Name: name, CertFile: name + ".crt"}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	exists, err := g.FS.Exists(ret.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists && !g.Config.OverwriteFiles {
+		ret.Skipped = true
+		return ret, nil
+	}
+
+	specs, err := g.Config.CertSpecs()
+	if err != nil {
+		return nil, err
+	}
+	defaultParams, err := CertParamsFromConfig(g.Config.CertConfig)
+	if err != nil {
+		return nil, err
+	}
+	caName, issue := defaultCA, NewIssue(csr, UsageServerClient, g.Config.ValidityPeriod.Duration)
+	issue.Extensions = defaultParams.Extensions
+	for _, spec := range specs {
+		if spec.Name == name {
+			caName, issue.Usage, issue.Validity = g.Config.CAName(spec.CA, defaultCA), spec.Usage, spec.Params.ValidityPeriod
+			issue.Extensions = spec.Params.Extensions
+		}
+	}
+	if g.Authorize != nil {
+		if err := g.Authorize(name, csr, issue); err != nil {
+			return nil, err
+		}
+	}
+	if g.LoadCA == nil {
+		return nil, fmt.Errorf("no certificate authority loader")
+	}
+	if ret.CA, err = g.LoadCA(caName); err != nil {
+		return nil, err
+	}
+	if ret.Cert, err = g.IssueCert(ret.CA, name, csr, issue); err != nil {
+		return nil, err
+	}
+	if err := g.FS.WriteFile(ret.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ret.Cert.Raw}), 0644); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,137 @@
+package generator
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerum/kube-cert-generator/pkg/cert"
+)
+
+var testNow = time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+
+// testRand is seeded random source. Crypto functions read single byte with 50% chance to keep callers
+// from depending on their output (randutil.MaybeReadByte), such reads do not advance the stream.
+type testRand struct {
+	r *mrand.Rand
+}
+
+func (t testRand) Read(p []byte) (int, error) {
+	if len(p) == 1 {
+		p[0] = 0
+		return 1, nil
+	}
+	return t.r.Read(p)
+}
+
+func testConfig() *Config {
+	cfg := &Config{
+		CertConfig: CertConfig{ValidityPeriod: Duration{time.Hour}, KeySize: 1024},
+		MasterNode: cert.Host{Alias: "master", Addresses: []string{"10.0.0.1", "master.example.com"}},
+		WorkerNodes: []cert.Host{
+			{Alias: "worker-1", Addresses: []string{"10.0.0.2"}},
+		},
+	}
+	cfg.CAConfig.ValidityPeriod = Duration{24 * time.Hour}
+	return cfg
+}
+
+// generateAll creates CSRs, CAs and certificates for config on MemFS with fixed random source and time
+func generateAll(t *testing.T, cfg *Config) (*MemFS, map[string]*CA) {
+	fs := NewMemFS()
+	g := New(cfg, fs)
+	g.Rand = testRand{mrand.New(mrand.NewSource(1))}
+	g.Now = func() time.Time { return testNow }
+
+	results, err := g.GenerateCSRs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := make(map[string]*CA)
+	for _, name := range []string{"root", DefaultFrontProxyCAName} {
+		if cas[name], err = g.InitCA(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.LoadCA = func(name string) (*CA, error) {
+		ca, ok := cas[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown CA %s", name)
+		}
+		return ca, nil
+	}
+	for _, result := range results {
+		if _, err := g.Sign("root", result.Spec.Name, result.CSR); err != nil {
+			t.Fatalf("%s: %v", result.Spec.Name, err)
+		}
+	}
+	return fs, cas
+}
+
+func readTestCert(t *testing.T, fs *MemFS, name string) *x509.Certificate {
+	content, err := fs.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		t.Fatalf("%s: no PEM data", name)
+	}
+	ret, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestGenerateIsDeterministicWithFixedRandAndNow(t *testing.T) {
+	fs1, cas1 := generateAll(t, testConfig())
+	fs2, cas2 := generateAll(t, testConfig())
+
+	for name, ca := range cas1 {
+		if !bytes.Equal(ca.Cert.Raw, cas2[name].Cert.Raw) {
+			t.Errorf("CA %s differs between runs", name)
+		}
+	}
+	names := fs1.Names()
+	if fmt.Sprint(names) != fmt.Sprint(fs2.Names()) {
+		t.Fatalf("files %v and %v differ between runs", names, fs2.Names())
+	}
+	for _, name := range names {
+		content1, _ := fs1.ReadFile(name)
+		content2, _ := fs2.ReadFile(name)
+		if !bytes.Equal(content1, content2) {
+			t.Errorf("%s differs between runs", name)
+		}
+		if perm := fs1.Mode(name); strings.HasSuffix(name, ".key") && perm != 0600 {
+			t.Errorf("%s is written with mode %v", name, perm)
+		}
+	}
+}
+
+func TestGenerateSignsCertificatesWithTheirCAs(t *testing.T) {
+	fs, cas := generateAll(t, testConfig())
+
+	specs, err := testConfig().CertSpecs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range specs {
+		cert := readTestCert(t, fs, spec.Name+".crt")
+		ca := cas[testConfig().CAName(spec.CA, "root")]
+		if err := cert.CheckSignatureFrom(ca.Cert); err != nil {
+			t.Errorf("%s is not signed by %s: %v", spec.Name, ca.Name, err)
+		}
+		if !cert.NotBefore.Equal(testNow) || !cert.NotAfter.Equal(testNow.Add(time.Hour)) {
+			t.Errorf("%s is valid from %v to %v", spec.Name, cert.NotBefore, cert.NotAfter)
+		}
+	}
+	if root := cas["root"].Cert; !root.NotAfter.Equal(testNow.Add(24 * time.Hour)) {
+		t.Errorf("CA is valid until %v, expected validity from CA section", root.NotAfter)
+	}
+}
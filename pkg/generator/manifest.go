@@ -0,0 +1,229 @@
+package generator
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files written together with generated files
+const (
+	ManifestFile          = "MANIFEST"
+	ManifestSignatureFile = "MANIFEST.sig"
+)
+
+const manifestSignatureBlock = "MANIFEST SIGNATURE"
+
+// ManifestEntry describes single generated file
+type ManifestEntry struct {
+	File        string `json:"file"`
+	SHA256      string `json:"sha256"`
+	Role        string `json:"role,omitempty"`        // group of certificate, e.g. etcd, or ca for CA certificates
+	Node        string `json:"node,omitempty"`        // alias of host which receives file
+	Fingerprint string `json:"fingerprint,omitempty"` // SHA-256 of first certificate in file
+}
+
+// Manifest lists generated files with their checksums
+type Manifest struct {
+	Created time.Time       `json:"created"`
+	Files   []ManifestEntry `json:"files"`
+}
+
+// CertFingerprint returns hex encoded SHA-256 of certificate
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewManifestEntry returns entry for file with given content, fingerprint is set if file contains certificate
+func NewManifestEntry(name string, content []byte) ManifestEntry {
+	sum := sha256.Sum256(content)
+	ret := ManifestEntry{File: name, SHA256: hex.EncodeToString(sum[:])}
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			ret.Fingerprint = CertFingerprint(cert)
+		}
+		break
+	}
+	return ret
+}
+
+// Add reads file from fs and adds it to manifest
+func (m *Manifest) Add(fs FS, name, role, node string) error {
+	content, err := fs.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	entry := NewManifestEntry(name, content)
+	entry.Role, entry.Node = role, node
+	m.Files = append(m.Files, entry)
+	return nil
+}
+
+// Check compares files in fs with manifest and returns found problems
+func (m *Manifest) Check(fs FS) []string {
+	var ret []string
+	for _, entry := range m.Files {
+		content, err := fs.ReadFile(entry.File)
+		if err != nil {
+			ret = append(ret, fmt.Sprintf("%s: %v", entry.File, err))
+			continue
+		}
+		actual := NewManifestEntry(entry.File, content)
+		switch {
+		case actual.SHA256 != entry.SHA256:
+			ret = append(ret, fmt.Sprintf("%s: SHA-256 %s does not match manifest %s", entry.File, actual.SHA256, entry.SHA256))
+		case actual.Fingerprint != entry.Fingerprint:
+			ret = append(ret, fmt.Sprintf("%s: certificate fingerprint %s does not match manifest %s", entry.File, actual.Fingerprint, entry.Fingerprint))
+		}
+	}
+	return ret
+}
+
+// signatureAlgorithm returns algorithm used to sign manifest with key, it is also used by x509 to check signature
+func signatureAlgorithm(key crypto.PublicKey) (x509.SignatureAlgorithm, crypto.Hash, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, crypto.Hash(0), nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported signing key %T", key)
+	}
+}
+
+// SignManifest encodes manifest and signs it with key. certs must start with certificate of key,
+// it may be followed by intermediate CAs, they are included into signature for verifier.
+func SignManifest(m *Manifest, key crypto.Signer, certs []*x509.Certificate) (manifest, signature []byte, err error) {
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificate of signing key")
+	}
+	sorted := *m
+	sorted.Files = append([]ManifestEntry(nil), m.Files...)
+	sort.Slice(sorted.Files, func(i, j int) bool { return sorted.Files[i].File < sorted.Files[j].File })
+	if manifest, err = json.MarshalIndent(sorted, "", "  "); err != nil {
+		return nil, nil, err
+	}
+	manifest = append(manifest, '\n')
+
+	algorithm, hash, err := signatureAlgorithm(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := manifest
+	if hash != 0 {
+		h := hash.New()
+		h.Write(manifest)
+		digest = h.Sum(nil)
+	}
+	sig, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := certs[0].CheckSignature(algorithm, manifest, sig); err != nil {
+		return nil, nil, fmt.Errorf("signing key does not match certificate %s: %v", certs[0].Subject, err)
+	}
+	if !IsManifestSigner(certs[0]) {
+		return nil, nil, fmt.Errorf("certificate %s is neither CA nor allowed to sign manifests", certs[0].Subject)
+	}
+
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: manifestSignatureBlock, Headers: map[string]string{"Algorithm": algorithm.String()}, Bytes: sig})
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return manifest, buf.Bytes(), nil
+}
+
+// IsManifestSigner reports whether certificate may sign manifest. Only CA certificates and dedicated
+// certificates with code signing usage are accepted, so keys of issued client and server certificates can not.
+func IsManifestSigner(cert *x509.Certificate) bool {
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return true
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageCodeSigning {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyManifest checks that manifest is signed by certificate issued by one of roots and decodes it.
+// If fingerprints are set signer certificate must have one of them, otherwise it must be accepted by IsManifestSigner.
+// Certificate which signed manifest is returned too.
+func VerifyManifest(manifest, signature []byte, roots *x509.CertPool, fingerprints []string) (*Manifest, *x509.Certificate, error) {
+	var sig []byte
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(signature); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case manifestSignatureBlock:
+			sig = block.Bytes
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse signer certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if sig == nil || len(certs) == 0 {
+		return nil, nil, fmt.Errorf("signature or signer certificate not found")
+	}
+	signer := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	usage := x509.ExtKeyUsageAny
+	if len(fingerprints) > 0 {
+		pinned := false
+		for _, fingerprint := range fingerprints {
+			pinned = pinned || strings.EqualFold(strings.Replace(fingerprint, ":", "", -1), CertFingerprint(signer))
+		}
+		if !pinned {
+			return nil, nil, fmt.Errorf("signer %s fingerprint %s is not pinned", signer.Subject, CertFingerprint(signer))
+		}
+	} else if !IsManifestSigner(signer) {
+		return nil, nil, fmt.Errorf("signer %s is neither CA nor allowed to sign manifests", signer.Subject)
+	} else if !signer.IsCA {
+		// chain must not restrict extended key usages to ones without code signing
+		usage = x509.ExtKeyUsageCodeSigning
+	}
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}); err != nil {
+		return nil, nil, fmt.Errorf("signer %s is not trusted: %v", signer.Subject, err)
+	}
+	algorithm, _, err := signatureAlgorithm(signer.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := signer.CheckSignature(algorithm, manifest, sig); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest signature: %v", err)
+	}
+	var ret Manifest
+	if err := json.Unmarshal(manifest, &ret); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return &ret, signer, nil
+}
@@ -0,0 +1,47 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// ParseRecipient parses age public key (age1...) or SSH public key in authorized_keys format
+func ParseRecipient(value string) (age.Recipient, error) {
+	switch {
+	case strings.HasPrefix(value, "age1"):
+		return age.ParseX25519Recipient(value)
+	case strings.HasPrefix(value, "ssh-"):
+		return agessh.ParseRecipient(value)
+	default:
+		return nil, fmt.Errorf("unknown recipient %q, must be age (age1...) or SSH (ssh-ed25519 ...) public key", value)
+	}
+}
+
+// ParseRecipients parses all recipients, see ParseRecipient
+func ParseRecipients(values []string) ([]age.Recipient, error) {
+	var ret []age.Recipient
+	for _, value := range values {
+		recipient, err := ParseRecipient(value)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, recipient)
+	}
+	return ret, nil
+}
+
+// ParseIdentities parses age identity file or unencrypted SSH private key
+func ParseIdentities(content []byte) ([]age.Identity, error) {
+	if bytes.Contains(content, []byte("PRIVATE KEY-----")) {
+		identity, err := agessh.ParseIdentity(content)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+	return age.ParseIdentities(bytes.NewReader(content))
+}
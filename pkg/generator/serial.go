@@ -0,0 +1,61 @@
+package generator
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Serial modes which may be set in CA config
+const (
+	SerialRandom     = "random"     // random 128-bit serials, default
+	SerialSequential = "sequential" // serials incremented by one, stored by caller in CA store
+)
+
+// SerialBits is length of random serial numbers
+const SerialBits = 128
+
+// maxSerialAttempts limits number of serials drawn when they are already used by CA
+const maxSerialAttempts = 16
+
+// RandomSerial returns positive serial with exactly SerialBits bits. High bit is always set
+// so all serials have the same length, other bits are random.
+func RandomSerial(r io.Reader) (*big.Int, error) {
+	buf := make([]byte, SerialBits/8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	buf[0] |= 0x80
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// Serial returns serial number for certificate issued by CA. It is taken from NextSerial or drawn randomly,
+// serials which SerialExists reports as used are skipped.
+func (g *Generator) Serial(ca *CA) (*big.Int, error) {
+	for attempt := 0; attempt < maxSerialAttempts; attempt++ {
+		var serial *big.Int
+		var err error
+		if g.NextSerial != nil {
+			serial, err = g.NextSerial(ca)
+		} else {
+			serial, err = RandomSerial(g.rand())
+		}
+		if err != nil {
+			return nil, err
+		}
+		if serial.Sign() <= 0 {
+			return nil, fmt.Errorf("serial number %v is not positive", serial)
+		}
+		if g.SerialExists == nil {
+			return serial, nil
+		}
+		exists, err := g.SerialExists(ca, serial)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check serial number: %v", err)
+		}
+		if !exists {
+			return serial, nil
+		}
+	}
+	return nil, fmt.Errorf("no unused serial number of %s found after %d attempts", ca.Name, maxSerialAttempts)
+}
@@ -0,0 +1,294 @@
+package generator
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Sink is FS which must be closed after all files are written, e.g. to flush archive
+type Sink interface {
+	FS
+	Close() error
+}
+
+// Close does nothing, files are written to directory immediately
+func (d DirFS) Close() error { return nil }
+
+// Close does nothing, files stay in memory
+func (m *MemFS) Close() error { return nil }
+
+// ArchiveFormat is format of archive written by ArchiveSink
+type ArchiveFormat string
+
+const (
+	ArchiveTar   ArchiveFormat = "tar"
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	ArchiveZip   ArchiveFormat = "zip"
+)
+
+// EncryptedSuffix is file name suffix of archives encrypted with age
+const EncryptedSuffix = ".age"
+
+var archiveSuffixes = []struct {
+	suffix string
+	format ArchiveFormat
+}{
+	{".tar", ArchiveTar},
+	{".tar.gz", ArchiveTarGz},
+	{".tgz", ArchiveTarGz},
+	{".zip", ArchiveZip},
+}
+
+// ArchiveFormatFromName returns archive format by file name extension, encrypted suffix is ignored
+func ArchiveFormatFromName(name string) (ArchiveFormat, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), EncryptedSuffix)
+	for _, archive := range archiveSuffixes {
+		if strings.HasSuffix(name, archive.suffix) {
+			return archive.format, true
+		}
+	}
+	return "", false
+}
+
+// ArchiveSink collects files in memory and writes them to archive when it is closed.
+// Files written before can be read back, so generation steps may use files created by previous ones.
+type ArchiveSink struct {
+	*MemFS
+	ModTime time.Time // modification time of archived files, time of Close if zero
+
+	w      io.WriteCloser
+	format ArchiveFormat
+}
+
+// NewArchiveSink creates sink writing archive to w, w is closed by Close
+func NewArchiveSink(w io.WriteCloser, format ArchiveFormat) *ArchiveSink {
+	return &ArchiveSink{MemFS: NewMemFS(), w: w, format: format}
+}
+
+// Close writes archive with all files sorted by name and closes underlying writer
+func (a *ArchiveSink) Close() error {
+	err := a.writeArchive()
+	if closeErr := a.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (a *ArchiveSink) writeArchive() error {
+	modTime := a.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names := make([]string, 0, len(a.files))
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch a.format {
+	case ArchiveTar, ArchiveTarGz:
+		var w io.Writer = a.w
+		var gz *gzip.Writer
+		if a.format == ArchiveTarGz {
+			gz = gzip.NewWriter(w)
+			w = gz
+		}
+		tw := tar.NewWriter(w)
+		for _, name := range names {
+			file := a.files[name]
+			header := &tar.Header{
+				Name:     name,
+				Mode:     int64(file.perm.Perm()),
+				Size:     int64(len(file.data)),
+				ModTime:  modTime,
+				Typeflag: tar.TypeReg,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := tw.Write(file.data); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if gz != nil {
+			return gz.Close()
+		}
+		return nil
+	case ArchiveZip:
+		zw := zip.NewWriter(a.w)
+		for _, name := range names {
+			file := a.files[name]
+			header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime}
+			header.SetMode(file.perm.Perm())
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(file.data); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	default:
+		return fmt.Errorf("unknown archive format %q", a.format)
+	}
+}
+
+// encryptedWriter encrypts data written to it and closes underlying file after encryption is finished
+type encryptedWriter struct {
+	io.WriteCloser
+	dst io.Closer
+}
+
+func (w *encryptedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if closeErr := w.dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// NewEncryptedArchiveSink creates sink writing archive encrypted with age to recipients, w is closed by Close
+func NewEncryptedArchiveSink(w io.WriteCloser, format ArchiveFormat, recipients ...age.Recipient) (*ArchiveSink, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients for encrypted archive")
+	}
+	enc, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	return NewArchiveSink(&encryptedWriter{WriteCloser: enc, dst: w}, format), nil
+}
+
+// OpenSink opens output target. Targets with archive extension (.tar, .tar.gz, .tgz, .zip) are written as
+// archive, archives with additional .age extension are encrypted to recipients. Other targets are directories.
+// Existing archive is replaced only if overwrite is set, like existing files in directory.
+func OpenSink(target string, recipients []age.Recipient, overwrite bool) (Sink, error) {
+	format, isArchive := ArchiveFormatFromName(target)
+	encrypted := strings.HasSuffix(strings.ToLower(target), EncryptedSuffix)
+	switch {
+	case encrypted && !isArchive:
+		return nil, fmt.Errorf("%s: only archives can be encrypted, use .tar.age, .tar.gz.age, .tgz.age or .zip.age", target)
+	case !encrypted && len(recipients) > 0:
+		return nil, fmt.Errorf("%s: recipients are set but output is not encrypted archive, add %s extension", target, EncryptedSuffix)
+	case encrypted && len(recipients) == 0:
+		return nil, fmt.Errorf("%s: no recipients to encrypt archive to", target)
+	case !isArchive:
+		return DirFS(target), nil
+	}
+
+	// archives contain private keys so they are readable by owner only
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(target, flags, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%s already exists, set overwrite_files to replace it", target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return NewArchiveSink(file, format), nil
+	}
+	sink, err := NewEncryptedArchiveSink(file, format, recipients...)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// ExtractArchive writes all regular files from archive to fs and returns their names.
+// Files with absolute paths or paths leading outside of archive root are refused.
+func ExtractArchive(r io.Reader, format ArchiveFormat, fs FS) ([]string, error) {
+	var ret []string
+	extract := func(name string, mode os.FileMode, content io.Reader) error {
+		clean := path.Clean(name)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("refusing to extract %q outside of output", name)
+		}
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		if err := fs.WriteFile(clean, data, mode.Perm()); err != nil {
+			return err
+		}
+		ret = append(ret, clean)
+		return nil
+	}
+
+	switch format {
+	case ArchiveTar, ArchiveTarGz:
+		if format == ArchiveTarGz {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return ret, nil
+			}
+			if err != nil {
+				return ret, err
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := extract(header.Name, os.FileMode(header.Mode), tr); err != nil {
+				return ret, err
+			}
+		}
+	case ArchiveZip:
+		// zip directory is at the end of archive so it is read to memory
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range zr.File {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			f, err := file.Open()
+			if err != nil {
+				return ret, err
+			}
+			err = extract(file.Name, file.Mode(), f)
+			f.Close()
+			if err != nil {
+				return ret, err
+			}
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+}
@@ -0,0 +1,266 @@
+package generator
+
+import (
+	"crypto/x509"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/containerum/kube-cert-generator/pkg/cert"
+)
+
+type csrParams struct {
+	FileName    string
+	CN          string
+	O           string
+	IncludeSANs bool
+	DNSNames    []string
+}
+
+func (c csrParams) String() string {
+	return fmt.Sprintf("File: %s, CN=%s, O=%s%s", c.FileName, c.CN, c.O, func() string {
+		if c.IncludeSANs {
+			return " with SANs"
+		}
+		return ""
+	}())
+}
+
+var kubeStandardCSRs = []csrParams{
+	{FileName: "admin", CN: "admin", O: "system:masters", IncludeSANs: false},
+	{FileName: "kube-controller-manager", CN: "system:kube-controller-manager", O: "system:kube-controller-manager", IncludeSANs: false},
+	{FileName: "kube-proxy", CN: "system:kube-proxy", O: "system:node-proxier", IncludeSANs: false},
+	{FileName: "kubernetes", CN: "kubernetes", O: "kubernetes", IncludeSANs: true, DNSNames: []string{"kubernetes", "kubernetes.default", "kubernetes.default.svc", "kubernetes.default.svc.cluster.local"}},
+	{FileName: "kube-scheduler", CN: "system:kube-scheduler", O: "system:kube-scheduler", IncludeSANs: false},
+	{FileName: "service-account", CN: "service-accounts", O: "Kubernetes", IncludeSANs: false},
+}
+
+// FrontProxyClientName is file name and common name of front proxy client certificate
+const FrontProxyClientName = "front-proxy-client"
+
+// CertUsage defines extended key usages of signed certificate
+type CertUsage int
+
+const (
+	UsageServerClient CertUsage = iota
+	UsageServer
+	UsageClient
+	UsageOCSPSigning // delegated OCSP responder
+)
+
+func (u CertUsage) ExtKeyUsage() []x509.ExtKeyUsage {
+	switch u {
+	case UsageServer:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case UsageClient:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case UsageOCSPSigning:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	default:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+}
+
+// CARole defines which certificate authority signs certificate
+type CARole int
+
+const (
+	CAMain CARole = iota
+	CAEtcd
+	CAFrontProxy
+)
+
+// CertSpec describes private key and certificate which are generated for config
+type CertSpec struct {
+	Name       string // file name without extension
+	Group      string
+	ConfigPath string // config entry which produced certificate, empty for standard certificates
+	Node       string // alias of host which receives certificate and key, master node for cluster-wide certificates
+	Params     cert.Params
+	Usage      CertUsage
+	CA         CARole
+}
+
+func (s CertSpec) String() string {
+	ret := fmt.Sprintf("File: %s, CN=%s, O=%s", s.Name, s.Params.CommonName, strings.Join(s.Params.Organization, ","))
+	if sans := s.Params.SubjectAdditionalNames; len(sans.DNSNames)+len(sans.IPAddresses)+len(sans.EmailAddresses)+len(sans.URLs) > 0 {
+		ret += " with SANs"
+	}
+	return ret
+}
+
+func (cfg *Config) newCertParams(certCfg CertConfig, cn, o string) (cert.Params, error) {
+	certParam, err := CertParamsFromConfig(certCfg)
+	if err != nil {
+		return cert.Params{}, err
+	}
+	certParam.CommonFields = cfg.CommonFields
+	if o != "" {
+		certParam.Organization = []string{o}
+	}
+	certParam.CommonName = cn
+	return certParam, nil
+}
+
+// kubeletCertSpecs returns kubelet client certificate used to access apiserver
+// and kubelet serving certificate verified by apiserver with --kubelet-certificate-authority
+func (cfg *Config) kubeletCertSpecs(configPath string, node cert.Host) ([]CertSpec, error) {
+	cn := fmt.Sprintf("system:node:%s", node.Alias)
+	client, err := cfg.newCertParams(cfg.CertConfig, cn, "system:nodes")
+	if err != nil {
+		return nil, err
+	}
+
+	serving, err := cfg.newCertParams(cfg.CertConfig, cn, "system:nodes")
+	if err != nil {
+		return nil, err
+	}
+	serving.SubjectAdditionalNames = node.ToSANs()
+
+	return []CertSpec{
+		{Name: node.Alias + "-kubelet-client", Group: "node", ConfigPath: configPath, Node: node.Alias, Params: client, Usage: UsageClient},
+		{Name: node.Alias + "-kubelet-serving", Group: "node", ConfigPath: configPath, Node: node.Alias, Params: serving, Usage: UsageServer},
+	}, nil
+}
+
+// etcdNodeCertSpecs returns etcd server, peer and healthcheck client certificates for etcd node
+func (cfg *Config) etcdNodeCertSpecs(configPath string, node cert.Host) ([]CertSpec, error) {
+	server, err := cfg.newCertParams(cfg.CertConfig, node.Alias, "")
+	if err != nil {
+		return nil, err
+	}
+	server.SubjectAdditionalNames = cert.Host{
+		Alias:     node.Alias,
+		Addresses: append(append([]string(nil), node.Addresses...), "localhost", "127.0.0.1", "::1"),
+	}.ToSANs()
+
+	peer, err := cfg.newCertParams(cfg.CertConfig, node.Alias, "")
+	if err != nil {
+		return nil, err
+	}
+	peer.SubjectAdditionalNames = node.ToSANs()
+
+	healthcheck, err := cfg.newCertParams(cfg.CertConfig, "kube-etcd-healthcheck-client", "system:masters")
+	if err != nil {
+		return nil, err
+	}
+
+	return []CertSpec{
+		// etcd uses server certificate as client one for its grpc gateway
+		{Name: node.Alias + "-etcd-server", Group: "etcd", ConfigPath: configPath, Node: node.Alias, Params: server, Usage: UsageServerClient, CA: CAEtcd},
+		{Name: node.Alias + "-etcd-peer", Group: "etcd", ConfigPath: configPath, Node: node.Alias, Params: peer, Usage: UsageServerClient, CA: CAEtcd},
+		{Name: node.Alias + "-etcd-healthcheck-client", Group: "etcd", ConfigPath: configPath, Node: node.Alias, Params: healthcheck, Usage: UsageClient, CA: CAEtcd},
+	}, nil
+}
+
+// CertSpecs returns all certificates which GenerateCSRs creates for config
+func (cfg *Config) CertSpecs() ([]CertSpec, error) {
+	var ret []CertSpec
+	for _, param := range kubeStandardCSRs {
+		certParam, err := cfg.newCertParams(cfg.CertConfig, param.CN, param.O)
+		if err != nil {
+			return nil, err
+		}
+		if param.IncludeSANs {
+			certParam.SubjectAdditionalNames = cfg.MasterNode.ToSANs()
+		}
+		if len(param.DNSNames) > 0 {
+			certParam.DNSNames = append(certParam.DNSNames, param.DNSNames...)
+		}
+		ret = append(ret, CertSpec{Name: param.FileName, Group: "basic kubernetes", Node: cfg.MasterNode.Alias, Params: certParam})
+	}
+
+	for i, node := range cfg.WorkerNodes {
+		specs, err := cfg.kubeletCertSpecs(fmt.Sprintf("worker_node[%d]", i), node)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, specs...)
+	}
+
+	// apiserver authenticates to aggregated API servers (metrics-server etc.) with this certificate
+	frontProxyClient, err := cfg.newCertParams(cfg.CertConfig, FrontProxyClientName, "")
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, CertSpec{Name: FrontProxyClientName, Group: "front proxy", Node: cfg.MasterNode.Alias, Params: frontProxyClient, Usage: UsageClient, CA: CAFrontProxy})
+
+	if len(cfg.EtcdNodes) > 0 {
+		certParam, err := cfg.newCertParams(cfg.CertConfig, "kube-apiserver-etcd-client", "system:masters")
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, CertSpec{Name: "apiserver-etcd-client", Group: "etcd", Node: cfg.MasterNode.Alias, Params: certParam, Usage: UsageClient, CA: CAEtcd})
+	}
+	for i, node := range cfg.EtcdNodes {
+		specs, err := cfg.etcdNodeCertSpecs(fmt.Sprintf("etcd_node[%d]", i), node)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, specs...)
+	}
+
+	for i, extraCert := range cfg.ExtraCerts {
+		certParam, err := CertParamsFromConfig(extraCert.CertConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		certParam.CommonFields = cfg.CommonFields
+		certParam.SubjectAdditionalNames = extraCert.Host.ToSANs()
+
+		str1, str2 := reflect.ValueOf(&certParam.CommonFields), reflect.ValueOf(&extraCert.CommonFields)
+		for i := 0; i < str1.Elem().NumField(); i++ {
+			if str2.Elem().Field(i).Len() > 0 {
+				str1.Elem().Field(i).Set(str2.Elem().Field(i))
+			}
+		}
+		node := extraCert.Host.Alias
+		if node == "" {
+			node = cfg.MasterNode.Alias
+		}
+		ret = append(ret, CertSpec{Name: extraCert.Name, Group: "extra", ConfigPath: fmt.Sprintf("extra_cert[%d]", i), Node: node, Params: certParam})
+	}
+	return ret, nil
+}
+
+// NodeRecipients returns recipients of all hosts with given alias, master node is included if it has this alias
+func (cfg *Config) NodeRecipients(alias string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	add := func(host cert.Host) {
+		if host.Alias != alias {
+			return
+		}
+		for _, recipient := range host.Recipients {
+			if !seen[recipient] {
+				seen[recipient] = true
+				ret = append(ret, recipient)
+			}
+		}
+	}
+	add(cfg.MasterNode)
+	for _, node := range cfg.WorkerNodes {
+		add(node)
+	}
+	for _, node := range cfg.EtcdNodes {
+		add(node)
+	}
+	for _, extraCert := range cfg.ExtraCerts {
+		add(extraCert.Host)
+	}
+	return ret
+}
+
+// CertNames returns names of all certificate files which GenerateCSRs creates for config
+func (cfg *Config) CertNames() ([]string, error) {
+	specs, err := cfg.CertSpecs()
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, spec := range specs {
+		ret = append(ret, spec.Name)
+	}
+	return ret, nil
+}